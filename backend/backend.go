@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"time"
+)
+
+var (
+	ErrJobNotComplete = errors.New("Job is not completed.")
+	ErrJobExpired     = errors.New("Job is expired.")
+)
+
+/*
+アップロードするデータ
+
+暗号化しながら読めるよう、ファイルではなく任意の位置から読めるものを渡す
+*/
+type Source interface {
+	io.ReaderAt
+	Size() int64
+}
+
+/*
+アーカイブの保存先
+
+Glacierの他、同じ手順(アップロード→取得要求→完了待ち→ダウンロード)で扱える
+保存先はこのインタフェースを実装する
+*/
+type Backend interface {
+	// データをアップロードしてアーカイブIDとツリーハッシュ(16進)を返す
+	Upload(logger *log.Logger, src Source) (archiveId, treeHash string, err error)
+
+	// アーカイブの取得要求を出してジョブIDを返す。tierを選べない保存先では無視する
+	RequestRetrieve(archiveId, tier string) (jobId string, err error)
+
+	// ジョブの状態を取得する
+	DescribeJob(jobId string) (*Job, error)
+
+	// 実行中/完了済みのジョブ一覧
+	JobList() ([]*Job, error)
+
+	// ジョブの出力をfilePathにダウンロードする。ジョブが完了していなければErrJobNotComplete、
+	// ジョブの出力の期限が切れていればErrJobExpiredを返す
+	DownloadFile(logger *log.Logger, jobId, filePath string) error
+
+	// アーカイブを削除する
+	DeleteArchive(archiveId string) error
+
+	// インベントリの取得要求を出してジョブIDを返す
+	RequestInventory() (jobId string, err error)
+
+	// インベントリジョブの結果を取得する。ジョブが完了していなければErrJobNotCompleteを返す
+	Inventory(jobId string) (*Inventory, error)
+}
+
+type Job struct {
+	JobId      string
+	Action     string
+	ArchiveId  string
+	StatusCode string
+	Tier       string
+	Completed  bool
+
+	CreationDate   time.Time
+	ArchiveSize    int64
+	SHA256TreeHash string
+
+	// 範囲取得の場合の取得範囲("from-to")。SHA256TreeHashはこの範囲のもの
+	RetrievalByteRange string
+}
+
+type Inventory struct {
+	InventoryDate time.Time
+	Archives      []Archive
+}
+
+type Archive struct {
+	ArchiveId      string
+	Description    string
+	CreationDate   time.Time
+	Size           int64
+	SHA256TreeHash string
+}
+
+/*
+取得要求を出さずにすぐダウンロードできる保存先
+
+これを実装する保存先ではsync時にex_requestを作らず、その場でダウンロード・復号する
+*/
+type DirectDownloader interface {
+	DownloadArchive(logger *log.Logger, archiveId, filePath string) error
+}
+
+/*
+中断したアップロードの状態
+*/
+type UploadState struct {
+	UploadId string
+	PartSize int64
+
+	// 記録済みのパート(開始位置 -> ツリーハッシュ)
+	Parts map[int64]string
+}
+
+/*
+アップロードの進捗の記録先
+*/
+type UploadStore interface {
+	// アップロードを開始した
+	Init(uploadId string, partSize int64) error
+
+	// startから始まるパートのアップロードが完了した
+	Part(start int64, treeHash string) error
+}
+
+/*
+中断したアップロードを再開できる保存先
+*/
+type ResumableUploader interface {
+	UploadResumable(logger *log.Logger, src Source, state UploadState, store UploadStore) (archiveId, treeHash string, err error)
+}
+
+/*
+保存先に残っている未完了のアップロード
+*/
+type MultipartUpload struct {
+	UploadId     string
+	Description  string
+	CreationDate time.Time
+	PartSize     int64
+}
+
+/*
+未完了のアップロードを列挙・中止できる保存先
+*/
+type MultipartLister interface {
+	ListUploads() ([]MultipartUpload, error)
+	AbortUpload(uploadId string) error
+}
@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// 範囲取得の境界
+const RANGE_ALIGN = 1024 * 1024
+
+/*
+アーカイブの一部だけを取得できる保存先
+*/
+type RangeRetriever interface {
+	// アーカイブのfrom〜to(両端を含む)の取得要求を出してジョブIDを返す。範囲はAlignRangeで揃えておくこと
+	RequestRetrieveRange(archiveId, tier string, from, to int64) (jobId string, err error)
+}
+
+/*
+取得範囲を1MB境界に広げる
+
+開始位置は1MBの倍数に切り下げ、終了位置は次の1MB境界の直前かアーカイブの末尾にする
+*/
+func AlignRange(from, to, size int64) (int64, int64) {
+	from -= from % RANGE_ALIGN
+	to = (to/RANGE_ALIGN+1)*RANGE_ALIGN - 1
+	if to >= size {
+		to = size - 1
+	}
+	return from, to
+}
+
+/*
+"from-to"形式の範囲を解析する
+*/
+func ParseRange(s string) (from, to int64, err error) {
+	_, err = fmt.Sscanf(s, "%d-%d", &from, &to)
+	if err != nil || from < 0 || from > to {
+		return 0, 0, errors.Errorf("不正な範囲です: %s", s)
+	}
+	return from, to, nil
+}
+
+func FormatRange(from, to int64) string {
+	return fmt.Sprintf("%d-%d", from, to)
+}
@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+/*
+再試行の方針
+
+失敗するたびに待ち時間を倍にし(上限MaxDelay)、ランダムに短くして同時に再試行が集中しないようにする。
+スロットリングされた場合はThrottleDelayから待つ。
+エラーの判定は保存先ごとに違うので、RetryableとThrottledは各バックエンドで設定する。どちらも元のエラー(errors.Cause)を受け取る
+*/
+type RetryPolicy struct {
+	MaxAttempts   int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	ThrottleDelay time.Duration
+
+	// 再試行して良いエラーか。nilなら全て再試行する
+	Retryable func(err error) bool
+
+	// スロットリングによるエラーか。nilならスロットリングを区別しない
+	Throttled func(err error) bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:   8,
+	BaseDelay:     time.Second,
+	MaxDelay:      time.Minute,
+	ThrottleDelay: 5 * time.Second,
+}
+
+/*
+再試行と失敗の回数(プロセス全体での累計)
+*/
+type RetryStats struct {
+	Retries   int64
+	Throttles int64
+	Failures  int64
+}
+
+var stats RetryStats
+
+func Stats() RetryStats {
+	return RetryStats{
+		Retries:   atomic.LoadInt64(&stats.Retries),
+		Throttles: atomic.LoadInt64(&stats.Throttles),
+		Failures:  atomic.LoadInt64(&stats.Failures),
+	}
+}
+
+/*
+fが成功するまで再試行する
+
+再試行しても無駄なエラー(パラメータ不正など)か、MaxAttempts回失敗したらエラーを返す
+*/
+func (p RetryPolicy) Do(logger *log.Logger, name string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+
+		cause := errors.Cause(err)
+		throttled := p.Throttled != nil && p.Throttled(cause)
+		if attempt >= p.MaxAttempts || (p.Retryable != nil && !p.Retryable(cause)) {
+			atomic.AddInt64(&stats.Failures, 1)
+			return errors.Wrapf(err, "%s: %d回目の試行で失敗しました", name, attempt)
+		}
+
+		d := p.delay(attempt, throttled)
+		atomic.AddInt64(&stats.Retries, 1)
+		if throttled {
+			atomic.AddInt64(&stats.Throttles, 1)
+		}
+		logger.Printf("%s: 失敗しました。%v後に再試行します(%d/%d)(%v)\n", name, d.Round(time.Millisecond), attempt, p.MaxAttempts, errors.Cause(err))
+		time.Sleep(d)
+	}
+}
+
+func (p RetryPolicy) delay(attempt int, throttled bool) time.Duration {
+	d := p.BaseDelay
+	if throttled && p.ThrottleDelay > d {
+		d = p.ThrottleDelay
+	}
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	// 半分〜そのままの間でばらつかせる
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
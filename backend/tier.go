@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const (
+	TIER_EXPEDITED = "Expedited"
+	TIER_STANDARD  = "Standard"
+	TIER_BULK      = "Bulk"
+)
+
+var (
+	// 安い順
+	Tiers = []string{TIER_BULK, TIER_STANDARD, TIER_EXPEDITED}
+
+	ErrNoTierInTime = errors.New("No tier can meet the deadline.")
+)
+
+/*
+取得の速さ(ティア)を選べる保存先
+
+ティアごとの取得にかかる最大時間を返す。対応していないティアは含まない
+*/
+type TierEstimator interface {
+	TierDurations() map[string]time.Duration
+}
+
+/*
+大文字小文字を無視してティア名を正規化する
+*/
+func ParseTier(s string) (string, error) {
+	for _, t := range Tiers {
+		if strings.EqualFold(s, t) {
+			return t, nil
+		}
+	}
+	return "", errors.Errorf("不明なティアです: %s", s)
+}
+
+/*
+needByまでに取得が完了する最も安いティアを選ぶ
+*/
+func ChooseTier(durations map[string]time.Duration, now, needBy time.Time) (string, error) {
+	for _, t := range Tiers {
+		d, ok := durations[t]
+		if !ok {
+			continue
+		}
+		if !now.Add(d).After(needBy) {
+			return t, nil
+		}
+	}
+	return "", ErrNoTierInTime
+}
+
+/*
+最も速いティアを選ぶ
+*/
+func FastestTier(durations map[string]time.Duration) string {
+	fastest := TIER_STANDARD
+	min := time.Duration(-1)
+	for _, t := range Tiers {
+		d, ok := durations[t]
+		if !ok {
+			continue
+		}
+		if min < 0 || d < min {
+			fastest = t
+			min = d
+		}
+	}
+	return fastest
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+const treeHashBlock = 1024 * 1024
+
+/*
+書き込まれたデータのツリーハッシュ(Glacierと同じ方式)を計算するio.Writer
+
+アップロードしながらハッシュを計算するのに使う
+*/
+type TreeHasher struct {
+	buf    []byte
+	hashes [][]byte
+}
+
+func NewTreeHasher() *TreeHasher {
+	return &TreeHasher{buf: make([]byte, 0, treeHashBlock)}
+}
+
+func (t *TreeHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := treeHashBlock - len(t.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		t.buf = append(t.buf, p[:m]...)
+		p = p[m:]
+		if len(t.buf) == treeHashBlock {
+			h := sha256.Sum256(t.buf)
+			t.hashes = append(t.hashes, h[:])
+			t.buf = t.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+func (t *TreeHasher) Sum() []byte {
+	hashes := t.hashes
+	if len(t.buf) > 0 || len(hashes) == 0 {
+		h := sha256.Sum256(t.buf)
+		hashes = append(hashes, h[:])
+	}
+	return treeFold(hashes)
+}
+
+/*
+1MBごとのハッシュを隣どうし連結してハッシュすることを繰り返し、1つにまとめる。余った1つはそのまま上の段に上げる
+*/
+func treeFold(hashes [][]byte) []byte {
+	for len(hashes) > 1 {
+		var next [][]byte
+		for i := 0; i < len(hashes); i += 2 {
+			if i+1 == len(hashes) {
+				next = append(next, hashes[i])
+				break
+			}
+			h := sha256.Sum256(append(append([]byte{}, hashes[i]...), hashes[i+1]...))
+			next = append(next, h[:])
+		}
+		hashes = next
+	}
+	return hashes[0]
+}
+
+// 16進文字列
+func (t *TreeHasher) String() string {
+	return fmt.Sprintf("%x", t.Sum())
+}
+
+/*
+rの終わりまでのツリーハッシュを計算する
+
+読み込みエラーがあれば返す
+*/
+func TreeHash(r io.Reader) ([]byte, error) {
+	t := NewTreeHasher()
+	_, err := io.Copy(t, r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return t.Sum(), nil
+}
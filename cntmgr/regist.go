@@ -2,21 +2,24 @@ package cntmgr
 
 import (
 	"database/sql"
-	"fmt"
 	"github.com/pkg/errors"
 	"log"
 	"os"
 	"path/filepath"
-	"github.com/rami1942/glaman/glacier-manager"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/model"
 	"github.com/rami1942/glaman/util"
+	"time"
 )
 
 /*
 アーカイブへの登録
 
-DB情報の更新とGlacierへの登録
+DB情報の更新とGlacierへの登録。
+暗号文はファイルに書き出さず、読みながら暗号化してアップロードする。中断した場合はResumeToArchiveで再開する。
+同じパスのエントリが既にあれば、その新しい版として登録する
 */
-func RegisterToArchive(logger *log.Logger, db *sql.DB, path, fileName, vaultName, region string, key []byte) (err error) {
+func RegisterToArchive(logger *log.Logger, db *sql.DB, be backend.Backend, dest model.Destination, path, fileName string, key []byte) (err error) {
 
 	iv, err := util.MakeIV()
 	if err != nil {
@@ -24,43 +27,252 @@ func RegisterToArchive(logger *log.Logger, db *sql.DB, path, fileName, vaultName
 	}
 
 	fullPath := filepath.Join(path, fileName)
-	encFilePath := fullPath + ".enc"
+	md5sum, sha256sum, err := util.GetSums(fullPath)
+	if err != nil {
+		return
+	}
 
-	// 暗号化
-	logger.Printf("暗号化: %v\n", fileName)
-	md5sum, err := util.Encrypt(fullPath, encFilePath, key, iv)
+	// 同じパスで登録済みのものがあれば前の版にする
+	prev, err := model.FindEntryByName(db, fileName)
 	if err != nil {
 		return
 	}
-	defer os.Remove(encFilePath)
+	if prev != nil && prev.ArchiveId == "" {
+		prev = nil
+	}
 
 	// 元データ情報記録
-	id, err := recordPlainFileMeta(db, path, fileName, md5sum, iv)
+	id, err := recordPlainFileMeta(db, path, fileName, md5sum, sha256sum, iv, prev)
 	if err != nil {
 		return
 	}
 
-	gmgr, err := glacier_manager.New("-", vaultName, region)
+	st := &model.UploadState{Id: id, Destination: dest.Name, StartDt: time.Now()}
+	err = model.SaveUploadState(db, *st)
 	if err != nil {
 		return
 	}
-	// アップロード
-	logger.Printf("アップロード: %v\n", fileName)
-	archiveId, err := gmgr.UploadFile(logger, encFilePath)
+
+	entry, err := model.FindEntryById(db, id)
+	if err != nil {
+		return
+	}
+	return uploadEntry(logger, db, be, dest, path, *entry, st, key)
+}
+
+/*
+アップロードが完了していないエントリのアップロードを再開する
+
+同じIVで暗号化するので暗号文は前回と同じになり、アップロード済みのパートはそのまま使える
+*/
+func ResumeToArchive(logger *log.Logger, db *sql.DB, be backend.Backend, dest model.Destination, path string, entry model.FileEntry, key []byte) (err error) {
+
+	fullPath := filepath.Join(path, entry.Name)
+	md5sum, err := util.GetMD5(fullPath)
+	if err != nil {
+		return
+	}
+	if md5sum != entry.MD5Sum {
+		// アップロード前に変更されたので登録し直す
+		logger.Printf("%v: アップロード完了前にファイルが変更されたため登録し直します\n", entry.Name)
+		err = discardEntry(db, entry.Id)
+		if err != nil {
+			return
+		}
+		return RegisterToArchive(logger, db, be, dest, path, entry.Name, key)
+	}
+
+	st, err := model.FindUploadState(db, entry.Id)
+	if err != nil {
+		return
+	}
+	if st == nil || st.Destination != dest.Name {
+		// 別の保存先へのアップロードは引き継げない
+		st = &model.UploadState{Id: entry.Id, Destination: dest.Name, StartDt: time.Now()}
+		err = model.DeleteUploadState(db, entry.Id)
+		if err != nil {
+			return
+		}
+		err = model.SaveUploadState(db, *st)
+		if err != nil {
+			return
+		}
+	}
+
+	return uploadEntry(logger, db, be, dest, path, entry, st, key)
+}
+
+/*
+ファイルを暗号化しながらアップロードし、完了したらエントリを確定させる
+
+失敗した場合はアップロード状態を残す
+*/
+func uploadEntry(logger *log.Logger, db *sql.DB, be backend.Backend, dest model.Destination, path string, entry model.FileEntry, st *model.UploadState, key []byte) (err error) {
+
+	iv, err := model.GetIV(db, entry.Id)
+	if err != nil {
+		return
+	}
+	fullPath := filepath.Join(path, entry.Name)
+	src, err := util.OpenEncrypted(fullPath, key, iv)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	logger.Printf("アップロード: %v\n", entry.Name)
+	var archiveId, treeHash string
+	if ru, ok := be.(backend.ResumableUploader); ok {
+		state := backend.UploadState{UploadId: st.UploadId, PartSize: st.PartSize, Parts: st.Parts}
+		archiveId, treeHash, err = ru.UploadResumable(logger, src, state, &uploadStore{db, st.Id, st.UploadId})
+	} else {
+		archiveId, treeHash, err = be.Upload(logger, src)
+	}
+	if err != nil {
+		return
+	}
+
+	// アップロード中に変更されていたら暗号文とMD5が一致しないので破棄する。次回のsyncで登録し直す
+	if changed(fullPath, entry) {
+		err = be.DeleteArchive(archiveId)
+		if err != nil {
+			return
+		}
+		err = discardEntry(db, entry.Id)
+		if err != nil {
+			return
+		}
+		return errors.Errorf("%v: アップロード中にファイルが変更されました", entry.Name)
+	}
+
+	err = model.UpdateArchiveId(db, entry.Id, archiveId)
+	if err != nil {
+		return
+	}
+	err = recordReplica(db, entry.Id, dest, archiveId, treeHash)
+	if err != nil {
+		return
+	}
+	if entry.PrevId != 0 {
+		err = model.ReplaceEntry(db, entry.PrevId, entry.Name, time.Now())
+		if err != nil {
+			return
+		}
+	}
+	err = model.DeleteUploadState(db, entry.Id)
 	if err != nil {
 		return
 	}
 
-	_, err = db.Exec("update file_entry set archive_id=? where id=?", archiveId, id)
+	logger.Printf("アップロード完了: %v\n", entry.Name)
+	return
+}
+
+/*
+登録時からサイズか更新日時が変わっているか
+*/
+func changed(fullPath string, entry model.FileEntry) bool {
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		return true
+	}
+	return fi.Size() != entry.Size || fi.ModTime().UnixNano() != entry.Mtime
+}
+
+/*
+アップロードが完了していないエントリを破棄する
+*/
+func discardEntry(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	err = model.DeleteEntry(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+/*
+アップロードの進捗をupload_state/upload_partに記録する
+*/
+type uploadStore struct {
+	db       *sql.DB
+	id       int64
+	uploadId string
+}
+
+func (s *uploadStore) Init(uploadId string, partSize int64) error {
+	s.uploadId = uploadId
+	return model.UpdateUploadId(s.db, s.id, uploadId, partSize)
+}
+
+func (s *uploadStore) Part(start int64, treeHash string) error {
+	return model.InsertUploadPart(s.db, s.uploadId, start, treeHash)
+}
+
+/*
+登録済みのエントリのコピーを別の保存先に作る
+
+元ファイルが手元にあることが前提。同じIVで暗号化するので暗号文は最初のアップロードと同じになる
+*/
+func ReplicateToArchive(logger *log.Logger, db *sql.DB, be backend.Backend, dest model.Destination, path string, entry model.FileEntry, key []byte) (err error) {
+
+	iv, err := model.GetIV(db, entry.Id)
+	if err != nil {
+		return
+	}
+
+	fullPath := filepath.Join(path, entry.Name)
+	md5sum, err := util.GetMD5(fullPath)
+	if err != nil {
+		return
+	}
+	if md5sum != entry.MD5Sum || changed(fullPath, entry) {
+		return errors.Errorf("%v: ファイルが登録時から変更されています", entry.Name)
+	}
+
+	src, err := util.OpenEncrypted(fullPath, key, iv)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	// アップロード
+	logger.Printf("アップロード(%v): %v\n", dest.Name, entry.Name)
+	archiveId, treeHash, err := be.Upload(logger, src)
+	if err != nil {
+		return
+	}
+
+	err = recordReplica(db, entry.Id, dest, archiveId, treeHash)
+	if err != nil {
+		return
+	}
 
-	logger.Printf("アップロード完了: %v\n", fileName)
+	logger.Printf("アップロード完了(%v): %v\n", dest.Name, entry.Name)
 	return
 }
 
-func recordPlainFileMeta(db *sql.DB, path, fileName string, md5sum, iv []byte) (id int64, err error) {
+func recordReplica(db *sql.DB, id int64, dest model.Destination, archiveId, treeHash string) error {
+	return model.InsertReplica(db, model.Replica{
+		EntryId:     id,
+		Destination: dest.Name,
+		Backend:     dest.Backend,
+		Region:      dest.Region,
+		Vault:       dest.Vault,
+		ArchiveId:   archiveId,
+		UploadDt:    time.Now(),
+		TreeHash:    treeHash,
+	})
+}
+
+/*
+内容とパスを記録する。prevがnilでなければその新しい版として記録し、ロックとコメントを引き継ぐ
+*/
+func recordPlainFileMeta(db *sql.DB, path, fileName, md5sum, sha256sum string, iv []byte, prev *model.FileEntry) (id int64, err error) {
 
 	fullPath := filepath.Join(path, fileName)
 
@@ -69,8 +281,14 @@ func recordPlainFileMeta(db *sql.DB, path, fileName string, md5sum, iv []byte) (
 		return 0, errors.WithStack(err)
 	}
 
-	result, err := db.Exec("insert into file_entry (md5sum, name, mtime, size) values (?, ?, ?, ?)",
-		fmt.Sprintf("%x", md5sum), fileName, fi.ModTime().UnixNano(), fi.Size())
+	var prevId int64
+	var lock int
+	if prev != nil {
+		prevId, lock = prev.Id, prev.Lock
+	}
+
+	result, err := db.Exec("insert into file_entry (md5sum, sha256, name, mtime, size, lock, prev_id) values (?, ?, ?, ?, ?, ?, ?)",
+		md5sum, sha256sum, fileName, fi.ModTime().UnixNano(), fi.Size(), lock, prevId)
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
@@ -86,5 +304,17 @@ func recordPlainFileMeta(db *sql.DB, path, fileName string, md5sum, iv []byte) (
 		return 0, errors.WithStack(err)
 	}
 
+	err = model.InsertPath(db, lastInsertID, fileName, fi.ModTime().UnixNano(), lock)
+	if err != nil {
+		return 0, err
+	}
+
+	if prev != nil {
+		_, err = db.Exec("insert into comments (id, comment) select ?, comment from comments where id=?", lastInsertID, prev.Id)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+
 	return lastInsertID, nil
 }
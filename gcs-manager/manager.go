@@ -0,0 +1,196 @@
+package gcs_manager
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	STORAGE_CLASS_COLDLINE = "COLDLINE"
+	STORAGE_CLASS_ARCHIVE  = "ARCHIVE"
+
+	keyPrefix = "glaman/"
+
+	actionRetrieval = "ArchiveRetrieval"
+	actionInventory = "InventoryRetrieval"
+
+	statusSucceeded = "Succeeded"
+)
+
+var (
+	_ backend.Backend          = (*Manager)(nil)
+	_ backend.DirectDownloader = (*Manager)(nil)
+)
+
+/*
+Google Cloud StorageのColdline/Archiveを保存先とするバックエンド
+
+GCSは取得要求なしにすぐダウンロードできるので、ジョブは常に完了扱いとする
+*/
+type Manager struct {
+	Bucket, StorageClass string
+
+	client *storage.Client
+}
+
+/*
+endpointを指定すると認証なしでそのURLに接続する(fake-gcs-server等での動作確認用)
+*/
+func New(bucket, storageClass, endpoint string) (*Manager, error) {
+	switch storageClass {
+	case STORAGE_CLASS_COLDLINE, STORAGE_CLASS_ARCHIVE:
+	default:
+		return nil, errors.Errorf("未対応のストレージクラスです: %s", storageClass)
+	}
+
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint), option.WithoutAuthentication())
+	}
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Manager{bucket, storageClass, client}, nil
+}
+
+func (m *Manager) Upload(logger *log.Logger, src backend.Source) (string, string, error) {
+	key, err := newKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	th := backend.NewTreeHasher()
+	w := m.object(key).NewWriter(context.Background())
+	w.StorageClass = m.StorageClass
+	_, err = io.Copy(io.MultiWriter(w, th), io.NewSectionReader(src, 0, src.Size()))
+	if err != nil {
+		w.Close()
+		return "", "", errors.WithStack(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	logger.Printf("Upload success. archiveId=%v\n", key)
+	return key, th.String(), nil
+}
+
+func (m *Manager) RequestRetrieve(archiveId, tier string) (string, error) {
+	return archiveId, nil
+}
+
+func (m *Manager) DescribeJob(jobId string) (*backend.Job, error) {
+	attrs, err := m.object(jobId).Attrs(context.Background())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &backend.Job{
+		JobId:        jobId,
+		Action:       actionRetrieval,
+		ArchiveId:    jobId,
+		StatusCode:   statusSucceeded,
+		Tier:         attrs.StorageClass,
+		Completed:    true,
+		CreationDate: attrs.Created,
+		ArchiveSize:  attrs.Size,
+	}, nil
+}
+
+/*
+GCSにはジョブが存在しない
+*/
+func (m *Manager) JobList() ([]*backend.Job, error) {
+	return nil, nil
+}
+
+func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) error {
+	return m.DownloadArchive(logger, jobId, filePath)
+}
+
+func (m *Manager) DownloadArchive(logger *log.Logger, archiveId, filePath string) error {
+	logger.Printf("Retrieve %s", filePath)
+
+	path, _ := filepath.Split(filePath)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	r, err := m.object(archiveId).NewReader(context.Background())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer r.Close()
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logger.Printf("Download done.\n")
+	return nil
+}
+
+func (m *Manager) DeleteArchive(archiveId string) error {
+	err := m.object(archiveId).Delete(context.Background())
+	return errors.WithStack(err)
+}
+
+/*
+GCSは一覧が即時に取れるのでジョブは発行しない。ジョブIDは便宜上のもの
+*/
+func (m *Manager) RequestInventory() (string, error) {
+	return actionInventory, nil
+}
+
+func (m *Manager) Inventory(jobId string) (*backend.Inventory, error) {
+	inv := &backend.Inventory{InventoryDate: time.Now()}
+
+	it := m.client.Bucket(m.Bucket).Objects(context.Background(), &storage.Query{Prefix: keyPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		inv.Archives = append(inv.Archives, backend.Archive{
+			ArchiveId:    attrs.Name,
+			CreationDate: attrs.Created,
+			Size:         attrs.Size,
+		})
+	}
+	return inv, nil
+}
+
+func (m *Manager) object(key string) *storage.ObjectHandle {
+	return m.client.Bucket(m.Bucket).Object(key)
+}
+
+func newKey() (string, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("%s%x", keyPrefix, b), nil
+}
@@ -0,0 +1,328 @@
+package gcs_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rami1942/glaman/backend"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucket = "test"
+
+/*
+テストで使うGCSのサブセット(JSON APIのアップロード・取得・一覧・削除と、XML APIのダウンロード)
+*/
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	// 最後の世代番号
+	generation int64
+}
+
+type fakeObject struct {
+	data         []byte
+	storageClass string
+	created      time.Time
+	generation   int64
+}
+
+type objectResource struct {
+	Kind         string `json:"kind"`
+	Bucket       string `json:"bucket"`
+	Name         string `json:"name"`
+	Size         string `json:"size"`
+	StorageClass string `json:"storageClass"`
+	Generation   string `json:"generation"`
+	TimeCreated  string `json:"timeCreated"`
+	Updated      string `json:"updated"`
+}
+
+func (s *fakeGCS) resource(name string, o *fakeObject) objectResource {
+	return objectResource{
+		Kind:         "storage#object",
+		Bucket:       testBucket,
+		Name:         name,
+		Size:         fmt.Sprintf("%d", len(o.data)),
+		StorageClass: o.storageClass,
+		Generation:   fmt.Sprintf("%d", o.generation),
+		TimeCreated:  o.created.Format(time.RFC3339Nano),
+		Updated:      o.created.Format(time.RFC3339Nano),
+	}
+}
+
+func (s *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	jsonPrefix := "/storage/v1/b/" + testBucket + "/o"
+	uploadPrefix := "/upload" + jsonPrefix
+
+	switch {
+	case strings.HasPrefix(path, uploadPrefix) && r.Method == "POST":
+		s.upload(w, r)
+	case path == jsonPrefix && r.Method == "GET":
+		s.list(w, r)
+	case strings.HasPrefix(path, jsonPrefix+"/"):
+		name, err := url.PathUnescape(strings.TrimPrefix(path, jsonPrefix+"/"))
+		if err != nil {
+			s.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("alt") == "media":
+			s.read(w, name)
+		case r.Method == "GET":
+			s.get(w, name)
+		case r.Method == "DELETE":
+			s.delete(w, name)
+		default:
+			s.error(w, http.StatusNotImplemented, "not implemented")
+		}
+	case strings.HasPrefix(path, "/"+testBucket+"/") && r.Method == "GET":
+		// XML APIでのダウンロード
+		name, err := url.PathUnescape(strings.TrimPrefix(path, "/"+testBucket+"/"))
+		if err != nil {
+			s.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.read(w, name)
+	default:
+		s.error(w, http.StatusNotFound, "unknown path: "+path)
+	}
+}
+
+/*
+uploadType=multipartのアップロード。メタデータ(JSON)と中身がmultipart/relatedで送られる
+*/
+func (s *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("uploadType") != "multipart" {
+		s.error(w, http.StatusNotImplemented, "only multipart upload is supported")
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	var meta struct {
+		Name         string `json:"name"`
+		StorageClass string `json:"storageClass"`
+	}
+	p, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(p).Decode(&meta)
+	}
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "metadata: "+err.Error())
+		return
+	}
+	var data []byte
+	p, err = mr.NextPart()
+	if err == nil {
+		data, err = ioutil.ReadAll(p)
+	}
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "media: "+err.Error())
+		return
+	}
+	if meta.StorageClass == "" {
+		meta.StorageClass = "STANDARD"
+	}
+
+	s.mu.Lock()
+	s.generation++
+	o := &fakeObject{data: data, storageClass: meta.StorageClass, created: time.Now().UTC(), generation: s.generation}
+	s.objects[meta.Name] = o
+	res := s.resource(meta.Name, o)
+	s.mu.Unlock()
+	s.writeJSON(w, res)
+}
+
+func (s *fakeGCS) get(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	o, ok := s.objects[name]
+	var res objectResource
+	if ok {
+		res = s.resource(name, o)
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.error(w, http.StatusNotFound, "No such object: "+name)
+		return
+	}
+	s.writeJSON(w, res)
+}
+
+func (s *fakeGCS) read(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	o, ok := s.objects[name]
+	s.mu.Unlock()
+	if !ok {
+		s.error(w, http.StatusNotFound, "No such object: "+name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(o.data)))
+	w.Header().Set("X-Goog-Generation", fmt.Sprintf("%d", o.generation))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	w.Header().Set("X-Goog-Storage-Class", o.storageClass)
+	w.Header().Set("Last-Modified", o.created.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	w.Write(o.data)
+}
+
+func (s *fakeGCS) delete(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	_, ok := s.objects[name]
+	delete(s.objects, name)
+	s.mu.Unlock()
+	if !ok {
+		s.error(w, http.StatusNotFound, "No such object: "+name)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *fakeGCS) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	s.mu.Lock()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	items := []objectResource{}
+	for _, name := range names {
+		items = append(items, s.resource(name, s.objects[name]))
+	}
+	s.mu.Unlock()
+
+	s.writeJSON(w, map[string]interface{}{"kind": "storage#objects", "items": items})
+}
+
+func (s *fakeGCS) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeGCS) error(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+}
+
+func TestNewRejectsUnknownClass(t *testing.T) {
+	_, err := New(testBucket, "STANDARD", "http://127.0.0.1:1/storage/v1/")
+	if err == nil {
+		t.Error("STANDARD is accepted")
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	srv := httptest.NewServer(&fakeGCS{objects: map[string]*fakeObject{}})
+	defer srv.Close()
+	m, err := New(testBucket, STORAGE_CLASS_ARCHIVE, srv.URL+"/storage/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	// ツリーハッシュはWriterへのコピーと同時に計算するので、1MBの区切りを何度かまたぐ大きさにする。
+	// Writerのチャンク(16MB)よりは小さいので1回のリクエストでアップロードされる
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*backend.RANGE_ALIGN+backend.RANGE_ALIGN/2)/16)
+	key, treeHash, err := m.Upload(logger, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.HasPrefix(key, keyPrefix) {
+		t.Errorf("key = %s", key)
+	}
+	h, err := backend.TreeHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if treeHash != fmt.Sprintf("%x", h) {
+		t.Errorf("tree hash = %s, want %x", treeHash, h)
+	}
+
+	// 取得要求は不要で、すぐに完了したジョブになる
+	jobId, err := m.RequestRetrieve(key, backend.TIER_BULK)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !job.Completed || job.ArchiveId != key || job.ArchiveSize != int64(len(data)) || job.Tier != STORAGE_CLASS_ARCHIVE {
+		t.Errorf("job = %+v", job)
+	}
+	jobs, err := m.JobList()
+	if err != nil || len(jobs) != 0 {
+		t.Errorf("JobList() = %v, %v", jobs, err)
+	}
+
+	dir, err := ioutil.TempDir("", "glaman-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, download := range []func(string) error{
+		func(out string) error { return m.DownloadFile(logger, jobId, out) },
+		func(out string) error { return m.DownloadArchive(logger, key, out) },
+	} {
+		out := filepath.Join(dir, "sub", "out")
+		err = download(out)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		got, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("downloaded %d bytes differ from uploaded %d bytes", len(got), len(data))
+		}
+		os.Remove(out)
+	}
+
+	inv, err := m.Inventory(actionInventory)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(inv.Archives) != 1 || inv.Archives[0].ArchiveId != key || inv.Archives[0].Size != int64(len(data)) {
+		t.Errorf("inventory = %+v", inv.Archives)
+	}
+
+	err = m.DeleteArchive(key)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	_, err = m.DescribeJob(key)
+	if err == nil {
+		t.Error("deleted object is found")
+	}
+	err = m.DownloadArchive(logger, key, filepath.Join(dir, "deleted"))
+	if err == nil {
+		t.Error("deleted object is downloaded")
+	}
+}
@@ -0,0 +1,324 @@
+package glacier_emulator
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	actionRetrieval = "ArchiveRetrieval"
+	actionInventory = "InventoryRetrieval"
+)
+
+// InitiateJobのリクエストボディ
+type jobParameters struct {
+	Type               string
+	ArchiveId          string
+	Tier               string
+	Format             string
+	SNSTopic           string
+	RetrievalByteRange string
+}
+
+// DescribeJob/ListJobsのレスポンス
+type jobDescription struct {
+	Action                string
+	ArchiveId             *string `json:",omitempty"`
+	ArchiveSizeInBytes    *int64  `json:",omitempty"`
+	ArchiveSHA256TreeHash *string `json:",omitempty"`
+	Completed             bool
+	CompletionDate        *string `json:",omitempty"`
+	CreationDate          string
+	InventorySizeInBytes  *int64 `json:",omitempty"`
+	JobId                 string
+	RetrievalByteRange    *string `json:",omitempty"`
+	SHA256TreeHash        *string `json:",omitempty"`
+	SNSTopic              *string `json:",omitempty"`
+	StatusCode            string
+	Tier                  string
+	VaultARN              string
+}
+
+// インベントリ出力
+type inventory struct {
+	VaultARN      string
+	InventoryDate string
+	ArchiveList   []inventoryItem
+}
+
+type inventoryItem struct {
+	ArchiveId          string
+	ArchiveDescription string
+	CreationDate       string
+	Size               int64
+	SHA256TreeHash     string
+}
+
+func (s *Server) initiateJob(w http.ResponseWriter, r *http.Request, v *vault) error {
+	var params jobParameters
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", err.Error()}
+	}
+
+	j := &job{
+		Tier:         params.Tier,
+		Format:       params.Format,
+		SNSTopic:     params.SNSTopic,
+		ByteRange:    params.RetrievalByteRange,
+		CreationDate: time.Now().UTC(),
+	}
+	if j.Tier == "" {
+		j.Tier = "Standard"
+	}
+	j.ReadyDate = j.CreationDate.Add(s.opts.JobDelay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch params.Type {
+	case "archive-retrieval":
+		if _, ok := v.Archives[params.ArchiveId]; !ok {
+			return &apiError{http.StatusNotFound, "ResourceNotFoundException", "archive not found"}
+		}
+		if j.ByteRange != "" {
+			_, _, err = retrievalRange(j.ByteRange, v.Archives[params.ArchiveId].Size)
+			if err != nil {
+				return err
+			}
+		}
+		j.Action = actionRetrieval
+		j.ArchiveId = params.ArchiveId
+	case "inventory-retrieval":
+		j.Action = actionInventory
+		v.LastInventoryDate = j.CreationDate
+	default:
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "unknown job type"}
+	}
+
+	j.JobId, err = newId()
+	if err != nil {
+		return err
+	}
+	v.Jobs[j.JobId] = j
+	err = s.save()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", s.location(v, "jobs", j.JobId))
+	w.Header().Set("x-amz-job-id", j.JobId)
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func (s *Server) describeJob(w http.ResponseWriter, r *http.Request, v *vault, jobId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := v.Jobs[jobId]
+	if !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "job not found"}
+	}
+	writeJSON(w, http.StatusOK, s.describe(v, j))
+	return nil
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request, v *vault) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []*job
+	for _, j := range v.Jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].CreationDate.Before(jobs[k].CreationDate) })
+
+	list := []jobDescription{}
+	for _, j := range jobs {
+		list = append(list, s.describe(v, j))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"JobList": list, "Marker": nil})
+	return nil
+}
+
+func (s *Server) getJobOutput(w http.ResponseWriter, r *http.Request, v *vault, jobId string) error {
+	s.mu.Lock()
+	j, ok := v.Jobs[jobId]
+	s.mu.Unlock()
+	if !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "job not found"}
+	}
+	if time.Now().Before(j.ReadyDate) {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "The job is not currently available for download"}
+	}
+	if s.inject(s.opts.FailRate) {
+		return errors.New("injected failure")
+	}
+
+	var body readSeekerAt
+	var size int64
+	if j.Action == actionInventory {
+		s.mu.Lock()
+		data, err := json.Marshal(s.inventory(v))
+		s.mu.Unlock()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		body = strings.NewReader(string(data))
+		size = int64(len(data))
+	} else {
+		f, err := os.Open(s.archivePath(v, j.ArchiveId))
+		if err != nil {
+			return &apiError{http.StatusNotFound, "ResourceNotFoundException", "archive not found"}
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		body = f
+		size = fi.Size()
+		if j.ByteRange != "" {
+			// 範囲取得ではその範囲だけが出力
+			rf, rt, err := retrievalRange(j.ByteRange, size)
+			if err != nil {
+				return err
+			}
+			body = io.NewSectionReader(f, rf, rt-rf+1)
+			size = rt - rf + 1
+		}
+	}
+
+	from, to := int64(0), size-1
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		_, err := fmt.Sscanf(rng, "bytes=%d-%d", &from, &to)
+		if err != nil || from > to || from >= size {
+			return &apiError{http.StatusRequestedRangeNotSatisfiable, "InvalidParameterValueException", "invalid range"}
+		}
+		if to >= size {
+			to = size - 1
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, size))
+	}
+	n := to - from + 1
+
+	// 1MB境界から始まる範囲にはツリーハッシュを付ける
+	if from%minPartSize == 0 {
+		h := glacier.ComputeHashes(io.NewSectionReader(body, from, n))
+		w.Header().Set("x-amz-sha256-tree-hash", hex.EncodeToString(h.TreeHash))
+	}
+
+	_, err := body.Seek(from, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", n))
+	w.WriteHeader(status)
+	io.CopyN(w, body, n)
+	return nil
+}
+
+// 呼び出し側でロックすること
+func (s *Server) describe(v *vault, j *job) jobDescription {
+	d := jobDescription{
+		Action:       j.Action,
+		CreationDate: j.CreationDate.Format(dateLayout),
+		JobId:        j.JobId,
+		StatusCode:   "InProgress",
+		Tier:         j.Tier,
+		VaultARN:     "arn:aws:glacier:emulator:000000000000:vaults/" + v.Name,
+	}
+	if j.SNSTopic != "" {
+		d.SNSTopic = &j.SNSTopic
+	}
+	if !time.Now().Before(j.ReadyDate) {
+		d.Completed = true
+		d.StatusCode = "Succeeded"
+		cd := j.ReadyDate.Format(dateLayout)
+		d.CompletionDate = &cd
+	}
+
+	if j.Action == actionInventory {
+		data, _ := json.Marshal(s.inventory(v))
+		size := int64(len(data))
+		d.InventorySizeInBytes = &size
+		return d
+	}
+
+	d.ArchiveId = &j.ArchiveId
+	if a, ok := v.Archives[j.ArchiveId]; ok {
+		d.ArchiveSizeInBytes = &a.Size
+		d.ArchiveSHA256TreeHash = &a.SHA256TreeHash
+		d.SHA256TreeHash = &a.SHA256TreeHash
+	}
+	if j.ByteRange != "" {
+		d.RetrievalByteRange = &j.ByteRange
+		// 範囲取得ではSHA256TreeHashはその範囲のもの
+		d.SHA256TreeHash = nil
+		if a, ok := v.Archives[j.ArchiveId]; ok {
+			rf, rt, err := retrievalRange(j.ByteRange, a.Size)
+			f, ferr := os.Open(s.archivePath(v, j.ArchiveId))
+			if err == nil && ferr == nil {
+				h := glacier.ComputeHashes(io.NewSectionReader(f, rf, rt-rf+1))
+				th := hex.EncodeToString(h.TreeHash)
+				d.SHA256TreeHash = &th
+			}
+			if ferr == nil {
+				f.Close()
+			}
+		}
+	}
+	return d
+}
+
+/*
+RetrievalByteRangeの解釈と検査
+
+開始位置は1MBの倍数、終了位置は1MB境界の直前かアーカイブの末尾でなければならない
+*/
+func retrievalRange(s string, size int64) (int64, int64, error) {
+	var from, to int64
+	_, err := fmt.Sscanf(s, "%d-%d", &from, &to)
+	if err != nil || from < 0 || from > to || to >= size ||
+		from%minPartSize != 0 || ((to+1)%minPartSize != 0 && to != size-1) {
+		return 0, 0, &apiError{http.StatusBadRequest, "InvalidParameterValueException", "invalid retrieval byte range: " + s}
+	}
+	return from, to, nil
+}
+
+// 呼び出し側でロックすること
+func (s *Server) inventory(v *vault) inventory {
+	inv := inventory{
+		VaultARN:      "arn:aws:glacier:emulator:000000000000:vaults/" + v.Name,
+		InventoryDate: time.Now().UTC().Format(time.RFC3339),
+		ArchiveList:   []inventoryItem{},
+	}
+	for _, a := range v.Archives {
+		inv.ArchiveList = append(inv.ArchiveList, inventoryItem{
+			ArchiveId:          a.ArchiveId,
+			ArchiveDescription: a.Description,
+			CreationDate:       a.CreationDate.Format(time.RFC3339),
+			Size:               a.Size,
+			SHA256TreeHash:     a.SHA256TreeHash,
+		})
+	}
+	sort.Slice(inv.ArchiveList, func(i, k int) bool { return inv.ArchiveList[i].ArchiveId < inv.ArchiveList[k].ArchiveId })
+	return inv
+}
+
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
@@ -0,0 +1,277 @@
+package glacier_emulator
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dateLayout = "2006-01-02T15:04:05.000Z"
+
+	stateFile  = "state.json"
+	archiveDir = "archives"
+	uploadDir  = "uploads"
+)
+
+/*
+エミュレータの動作設定
+*/
+type Options struct {
+	// アーカイブ等の保存先
+	Dir string
+
+	// ジョブ発行から完了までの時間
+	JobDelay time.Duration
+
+	// UploadMultipartPart/GetJobOutputが500エラーになる確率(0-1)
+	FailRate float64
+
+	// 全リクエストがThrottlingExceptionになる確率(0-1)
+	ThrottleRate float64
+
+	Logger *log.Logger
+}
+
+/*
+glacier_managerが使うGlacier REST APIのサブセットを実装したHTTPサーバ
+
+認証(署名)は検証しない。アカウントIDは無視する
+*/
+type Server struct {
+	opts Options
+
+	mu    sync.Mutex
+	state state
+	rnd   *mrand.Rand
+}
+
+// 永続化する状態
+type state struct {
+	Vaults map[string]*vault
+}
+
+type vault struct {
+	Name              string
+	CreationDate      time.Time
+	LastInventoryDate time.Time
+	Archives          map[string]*archive
+	Uploads           map[string]*upload
+	Jobs              map[string]*job
+}
+
+type archive struct {
+	ArchiveId      string
+	Description    string
+	Size           int64
+	SHA256TreeHash string
+	CreationDate   time.Time
+}
+
+type upload struct {
+	UploadId     string
+	Description  string
+	PartSize     int64
+	CreationDate time.Time
+	// 開始位置 -> パート
+	Parts map[int64]*part
+}
+
+type part struct {
+	End      int64
+	TreeHash string
+}
+
+type job struct {
+	JobId        string
+	Action       string
+	ArchiveId    string
+	Tier         string
+	Format       string
+	SNSTopic     string
+	ByteRange    string
+	CreationDate time.Time
+	ReadyDate    time.Time
+}
+
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func New(opts Options) (*Server, error) {
+	for _, d := range []string{archiveDir, uploadDir} {
+		err := os.MkdirAll(filepath.Join(opts.Dir, d), 0755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	s := &Server{
+		opts:  opts,
+		state: state{Vaults: map[string]*vault{}},
+		rnd:   mrand.New(mrand.NewSource(time.Now().UnixNano())),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(opts.Dir, stateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &s.state)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.opts.Logger.Printf("%s %s", r.Method, r.URL.Path)
+
+	err := s.dispatch(w, r)
+	if err != nil {
+		s.opts.Logger.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		writeError(w, err)
+	}
+}
+
+/*
+パスは /{account}/vaults/{vault}/... の形式
+*/
+func (s *Server) dispatch(w http.ResponseWriter, r *http.Request) error {
+	if s.inject(s.opts.ThrottleRate) {
+		return &apiError{http.StatusBadRequest, "ThrottlingException", "injected throttling"}
+	}
+
+	p := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(p) < 2 || p[1] != "vaults" {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "unknown path"}
+	}
+
+	switch {
+	case len(p) == 2 && r.Method == "GET":
+		return s.listVaults(w, r)
+	case len(p) == 3 && r.Method == "PUT":
+		return s.createVault(w, r, p[2])
+	}
+
+	s.mu.Lock()
+	v, ok := s.state.Vaults[p[2]]
+	s.mu.Unlock()
+	if !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "vault not found: " + p[2]}
+	}
+
+	rest := p[3:]
+	switch {
+	case len(rest) == 0 && r.Method == "GET":
+		return s.describeVault(w, r, v)
+	case len(rest) == 1 && rest[0] == "multipart-uploads" && r.Method == "GET":
+		return s.listMultipartUploads(w, r, v)
+	case len(rest) == 1 && rest[0] == "multipart-uploads" && r.Method == "POST":
+		return s.initiateMultipartUpload(w, r, v)
+	case len(rest) == 2 && rest[0] == "multipart-uploads" && r.Method == "GET":
+		return s.listParts(w, r, v, rest[1])
+	case len(rest) == 2 && rest[0] == "multipart-uploads" && r.Method == "PUT":
+		return s.uploadMultipartPart(w, r, v, rest[1])
+	case len(rest) == 2 && rest[0] == "multipart-uploads" && r.Method == "POST":
+		return s.completeMultipartUpload(w, r, v, rest[1])
+	case len(rest) == 2 && rest[0] == "multipart-uploads" && r.Method == "DELETE":
+		return s.abortMultipartUpload(w, r, v, rest[1])
+	case len(rest) == 1 && rest[0] == "jobs" && r.Method == "POST":
+		return s.initiateJob(w, r, v)
+	case len(rest) == 1 && rest[0] == "jobs" && r.Method == "GET":
+		return s.listJobs(w, r, v)
+	case len(rest) == 2 && rest[0] == "jobs" && r.Method == "GET":
+		return s.describeJob(w, r, v, rest[1])
+	case len(rest) == 3 && rest[0] == "jobs" && rest[2] == "output" && r.Method == "GET":
+		return s.getJobOutput(w, r, v, rest[1])
+	case len(rest) == 2 && rest[0] == "archives" && r.Method == "DELETE":
+		return s.deleteArchive(w, r, v, rest[1])
+	}
+	return &apiError{http.StatusNotFound, "ResourceNotFoundException", "unsupported operation"}
+}
+
+// 呼び出し側でロックすること
+func (s *Server) save() error {
+	data, err := json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := filepath.Join(s.opts.Dir, stateFile+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, filepath.Join(s.opts.Dir, stateFile)))
+}
+
+// 確率rateでtrueを返す
+func (s *Server) inject(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rnd.Float64() < rate
+}
+
+func (s *Server) archivePath(v *vault, archiveId string) string {
+	return filepath.Join(s.opts.Dir, archiveDir, v.Name+"-"+archiveId)
+}
+
+func (s *Server) uploadPath(v *vault, uploadId string) string {
+	return filepath.Join(s.opts.Dir, uploadDir, v.Name+"-"+uploadId)
+}
+
+func (s *Server) location(v *vault, kind, id string) string {
+	return fmt.Sprintf("/-/vaults/%s/%s/%s", v.Name, kind, id)
+}
+
+func newId() (string, error) {
+	b := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	ae, ok := errors.Cause(err).(*apiError)
+	if !ok {
+		ae = &apiError{http.StatusInternalServerError, "ServiceUnavailableException", err.Error()}
+	}
+	w.Header().Set("X-Amzn-Errortype", ae.code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ae.status)
+	data, _ := json.Marshal(map[string]string{"code": ae.code, "message": ae.message, "type": "Client"})
+	w.Write(data)
+}
@@ -0,0 +1,290 @@
+package glacier_emulator
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	minPartSize = 1024 * 1024
+	maxPartSize = 4 * 1024 * 1024 * 1024
+)
+
+func (s *Server) initiateMultipartUpload(w http.ResponseWriter, r *http.Request, v *vault) error {
+	partSize, err := strconv.ParseInt(r.Header.Get("x-amz-part-size"), 10, 64)
+	if err != nil || partSize < minPartSize || partSize > maxPartSize || partSize&(partSize-1) != 0 {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "invalid part size"}
+	}
+
+	uploadId, err := newId()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(s.uploadPath(v, uploadId))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f.Close()
+
+	s.mu.Lock()
+	v.Uploads[uploadId] = &upload{
+		UploadId:     uploadId,
+		Description:  r.Header.Get("x-amz-archive-description"),
+		PartSize:     partSize,
+		CreationDate: time.Now().UTC(),
+		Parts:        map[int64]*part{},
+	}
+	err = s.save()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", s.location(v, "multipart-uploads", uploadId))
+	w.Header().Set("x-amz-multipart-upload-id", uploadId)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) uploadMultipartPart(w http.ResponseWriter, r *http.Request, v *vault, uploadId string) error {
+	if s.inject(s.opts.FailRate) {
+		io.Copy(ioutil.Discard, r.Body)
+		return errors.New("injected failure")
+	}
+
+	s.mu.Lock()
+	u, ok := v.Uploads[uploadId]
+	s.mu.Unlock()
+	if !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "upload not found"}
+	}
+
+	var start, end int64
+	_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end)
+	if err != nil || start%u.PartSize != 0 || end < start || end-start+1 > u.PartSize {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "invalid content range"}
+	}
+
+	// 受信したデータを所定の位置に書き込んでからツリーハッシュを検証する
+	f, err := os.OpenFile(s.uploadPath(v, uploadId), os.O_RDWR, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(&offsetWriter{f, start}, r.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n != end-start+1 {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "content length does not match range"}
+	}
+
+	h := glacier.ComputeHashes(io.NewSectionReader(f, start, n))
+	treeHash := hex.EncodeToString(h.TreeHash)
+	if treeHash != r.Header.Get("x-amz-sha256-tree-hash") {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "checksum mismatch: " + treeHash}
+	}
+
+	s.mu.Lock()
+	u.Parts[start] = &part{end, treeHash}
+	err = s.save()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("x-amz-sha256-tree-hash", treeHash)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, v *vault, uploadId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := v.Uploads[uploadId]
+	if !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "upload not found"}
+	}
+
+	size, err := strconv.ParseInt(r.Header.Get("x-amz-archive-size"), 10, 64)
+	if err != nil || size <= 0 {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "invalid archive size"}
+	}
+
+	// パートが欠けていないか
+	var hashes [][]byte
+	for p := int64(0); p < size; p += u.PartSize {
+		pt, ok := u.Parts[p]
+		if !ok {
+			return &apiError{http.StatusBadRequest, "InvalidParameterValueException", fmt.Sprintf("part at %d is missing", p)}
+		}
+		b, _ := hex.DecodeString(pt.TreeHash)
+		hashes = append(hashes, b)
+	}
+	treeHash := hex.EncodeToString(glacier.ComputeTreeHash(hashes))
+	if treeHash != r.Header.Get("x-amz-sha256-tree-hash") {
+		return &apiError{http.StatusBadRequest, "InvalidParameterValueException", "checksum mismatch: " + treeHash}
+	}
+
+	archiveId, err := newId()
+	if err != nil {
+		return err
+	}
+	err = os.Truncate(s.uploadPath(v, uploadId), size)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Rename(s.uploadPath(v, uploadId), s.archivePath(v, archiveId))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	v.Archives[archiveId] = &archive{
+		ArchiveId:      archiveId,
+		Description:    u.Description,
+		Size:           size,
+		SHA256TreeHash: treeHash,
+		CreationDate:   time.Now().UTC(),
+	}
+	delete(v.Uploads, uploadId)
+	err = s.save()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", s.location(v, "archives", archiveId))
+	w.Header().Set("x-amz-archive-id", archiveId)
+	w.Header().Set("x-amz-sha256-tree-hash", treeHash)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+type uploadDescription struct {
+	ArchiveDescription string
+	CreationDate       string
+	MultipartUploadId  string
+	PartSizeInBytes    int64
+	VaultARN           string
+}
+
+func (s *Server) listMultipartUploads(w http.ResponseWriter, r *http.Request, v *vault) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var uploads []*upload
+	for _, u := range v.Uploads {
+		uploads = append(uploads, u)
+	}
+	sort.Slice(uploads, func(i, k int) bool { return uploads[i].CreationDate.Before(uploads[k].CreationDate) })
+
+	list := []uploadDescription{}
+	for _, u := range uploads {
+		list = append(list, uploadDescription{
+			ArchiveDescription: u.Description,
+			CreationDate:       u.CreationDate.Format(dateLayout),
+			MultipartUploadId:  u.UploadId,
+			PartSizeInBytes:    u.PartSize,
+			VaultARN:           "arn:aws:glacier:emulator:000000000000:vaults/" + v.Name,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"UploadsList": list, "Marker": nil})
+	return nil
+}
+
+type partDescription struct {
+	RangeInBytes   string
+	SHA256TreeHash string
+}
+
+func (s *Server) listParts(w http.ResponseWriter, r *http.Request, v *vault, uploadId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := v.Uploads[uploadId]
+	if !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "upload not found"}
+	}
+
+	parts := []partDescription{}
+	for _, start := range sortedParts(u) {
+		pt := u.Parts[start]
+		parts = append(parts, partDescription{fmt.Sprintf("%d-%d", start, pt.End), pt.TreeHash})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ArchiveDescription": u.Description,
+		"CreationDate":       u.CreationDate.Format(dateLayout),
+		"Marker":             nil,
+		"MultipartUploadId":  u.UploadId,
+		"PartSizeInBytes":    u.PartSize,
+		"Parts":              parts,
+		"VaultARN":           "arn:aws:glacier:emulator:000000000000:vaults/" + v.Name,
+	})
+	return nil
+}
+
+// パートの開始位置を昇順で返す
+func sortedParts(u *upload) []int64 {
+	var starts []int64
+	for start := range u.Parts {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, k int) bool { return starts[i] < starts[k] })
+	return starts
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, v *vault, uploadId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := v.Uploads[uploadId]; !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "upload not found"}
+	}
+	delete(v.Uploads, uploadId)
+	os.Remove(s.uploadPath(v, uploadId))
+	err := s.save()
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) deleteArchive(w http.ResponseWriter, r *http.Request, v *vault, archiveId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := v.Archives[archiveId]; !ok {
+		return &apiError{http.StatusNotFound, "ResourceNotFoundException", "archive not found"}
+	}
+	delete(v.Archives, archiveId)
+	os.Remove(s.archivePath(v, archiveId))
+	err := s.save()
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// 開始位置から順に書き込むio.Writer
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,80 @@
+package glacier_emulator
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DescribeVault/ListVaultsのレスポンス
+type vaultDescription struct {
+	CreationDate      string
+	LastInventoryDate *string `json:",omitempty"`
+	NumberOfArchives  int64
+	SizeInBytes       int64
+	VaultARN          string
+	VaultName         string
+}
+
+func (s *Server) createVault(w http.ResponseWriter, r *http.Request, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 既に存在する場合も成功扱い(Glacierと同じ)
+	if _, ok := s.state.Vaults[name]; !ok {
+		s.state.Vaults[name] = &vault{
+			Name:         name,
+			CreationDate: time.Now().UTC(),
+			Archives:     map[string]*archive{},
+			Uploads:      map[string]*upload{},
+			Jobs:         map[string]*job{},
+		}
+		err := s.save()
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Location", "/-/vaults/"+name)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) describeVault(w http.ResponseWriter, r *http.Request, v *vault) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, describeVault(v))
+	return nil
+}
+
+func (s *Server) listVaults(w http.ResponseWriter, r *http.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []vaultDescription{}
+	for _, v := range s.state.Vaults {
+		list = append(list, describeVault(v))
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].VaultName < list[k].VaultName })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"VaultList": list, "Marker": nil})
+	return nil
+}
+
+// 呼び出し側でロックすること
+func describeVault(v *vault) vaultDescription {
+	d := vaultDescription{
+		CreationDate: v.CreationDate.Format(dateLayout),
+		VaultARN:     "arn:aws:glacier:emulator:000000000000:vaults/" + v.Name,
+		VaultName:    v.Name,
+	}
+	if !v.LastInventoryDate.IsZero() {
+		lid := v.LastInventoryDate.Format(dateLayout)
+		d.LastInventoryDate = &lid
+	}
+	for _, a := range v.Archives {
+		d.NumberOfArchives++
+		d.SizeInBytes += a.Size
+	}
+	return d
+}
@@ -2,12 +2,18 @@ package glacier_manager
 
 import (
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/glacier"
 	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 )
 
@@ -18,7 +24,8 @@ const (
 )
 
 var (
-	ErrJobNotComplete = errors.New("Job is not completed.")
+	ErrJobNotComplete = backend.ErrJobNotComplete
+	ErrJobExpired     = backend.ErrJobExpired
 )
 
 type dlSpec struct {
@@ -26,16 +33,27 @@ type dlSpec struct {
 	from, to int64
 }
 
+/*
+ジョブの出力をチャンクに分けてダウンロードする
+
+ダウンロードしたチャンクはツリーハッシュを確認してから保存し、全チャンクが揃うまで残しておく。
+中断した場合は次回の実行で欠けているチャンクだけをダウンロードする
+*/
 func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) (err error) {
 	logger.Printf("check job %s", filePath)
 	// ジョブ一覧取得
 	job, err := m.DescribeJob(jobId)
 	if err != nil {
 		err = errors.Cause(err)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException {
+			// 期限切れのジョブのチャンクは使えない
+			removeChunks(filePath)
+			return ErrJobExpired
+		}
 		return
 	}
 
-	if !*job.Completed {
+	if !job.Completed {
 		return ErrJobNotComplete
 	}
 	logger.Printf("Retrieve job %s", filePath)
@@ -46,14 +64,22 @@ func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) (err
 		return errors.WithStack(err)
 	}
 
-	size := *job.ArchiveSizeInBytes
+	size := job.ArchiveSize
+	if job.RetrievalByteRange != "" {
+		// 範囲取得の出力は範囲の長さ
+		from, to, err := backend.ParseRange(job.RetrievalByteRange)
+		if err != nil {
+			return err
+		}
+		size = to - from + 1
+	}
 	chunkSize := int64(DL_CHUNK_SIZE)
 
 	var chunks []dlSpec
 	i := 1
 	for p := int64(0); p < size; p += chunkSize {
 		px := p + chunkSize - 1
-		if px > size {
+		if px >= size {
 			px = size - 1
 		}
 		chunks = append(chunks, dlSpec{i, p, px})
@@ -66,9 +92,10 @@ func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) (err
 	}
 	close(q)
 	logger.Printf("Num chunks = %d", len(chunks))
-	defer cleanupTemp(filePath, len(chunks))
 
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var dlErr error
 	for i := 0; i < NUM_DL_GOROUTINE; i++ {
 		wg.Add(1)
 		go func() {
@@ -79,12 +106,21 @@ func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) (err
 				if !ok {
 					return
 				}
-				m.downloadChunk(cp, jobId, filePath)
+				err := m.downloadChunk(logger, cp, jobId, filePath)
+				if err != nil {
+					mu.Lock()
+					dlErr = err
+					mu.Unlock()
+				}
 			}
 
 		}()
 	}
 	wg.Wait()
+	if dlErr != nil {
+		// 欠けたチャンクをマージしない
+		return dlErr
+	}
 	logger.Printf("Download done.\n")
 
 	// マージ
@@ -97,65 +133,147 @@ func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) (err
 	defer of.Close()
 
 	for i := 1; i <= len(chunks); i++ {
-		path, fileName := filepath.Split(filePath)
-		fn := filepath.Join(path, fmt.Sprintf("mars-%v_%03d.tmp", fileName, i))
-
-		err = doAppend(of, fn)
+		err = doAppend(of, chunkPath(filePath, i))
 		if err != nil {
 			err = errors.WithMessage(err, fmt.Sprintf("pos =%v", i))
 			return
 		}
 	}
+	removeChunks(filePath)
 	return
 }
 
-func cleanupTemp(filePath string, n int) {
-	for i := 1; i <= n; i++ {
-		path, fileName := filepath.Split(filePath)
-		fn := filepath.Join(path, fmt.Sprintf("mars-%v_%03d.tmp", fileName, i))
+func chunkPath(filePath string, id int) string {
+	path, fileName := filepath.Split(filePath)
+	return filepath.Join(path, fmt.Sprintf("mars-%v_%03d.tmp", fileName, id))
+}
+
+// チャンクのジョブIDとツリーハッシュを記録するファイル
+func chunkHashPath(filePath string, id int) string {
+	return chunkPath(filePath, id) + ".sha256"
+}
+
+var chunkFileRe = regexp.MustCompile(`^mars-.+_[0-9]{3,}\.tmp(\.sha256)?$`)
+
+/*
+ダウンロード途中のチャンク(またはそのハッシュ)のファイルか
+*/
+func IsChunkFile(fileName string) bool {
+	return chunkFileRe.MatchString(fileName)
+}
+
+func removeChunks(filePath string) {
+	path, fileName := filepath.Split(filePath)
+	files, _ := filepath.Glob(filepath.Join(path, fmt.Sprintf("mars-%v_[0-9][0-9][0-9]*.tmp*", escapeGlob(fileName))))
+	for _, fn := range files {
 		os.Remove(fn)
 	}
 }
 
-func (m *Manager) downloadChunk(spec dlSpec, jobId, filePath string) {
+func escapeGlob(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+	return r.Replace(s)
+}
+
+/*
+前回までにダウンロードしたチャンクが使えるか
+
+同じジョブのもので、記録したツリーハッシュと内容が一致すること
+*/
+func chunkDownloaded(filePath, jobId string, spec dlSpec) bool {
+	data, err := ioutil.ReadFile(chunkHashPath(filePath, spec.id))
+	if err != nil {
+		return false
+	}
+	var recJobId, recHash string
+	_, err = fmt.Sscanf(string(data), "%s %s", &recJobId, &recHash)
+	if err != nil || recJobId != jobId {
+		return false
+	}
+
+	f, err := os.Open(chunkPath(filePath, spec.id))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != spec.to-spec.from+1 {
+		return false
+	}
+	h, err := backend.TreeHash(f)
+	return err == nil && fmt.Sprintf("%x", h) == recHash
+}
+
+func (m *Manager) downloadChunk(logger *log.Logger, spec dlSpec, jobId, filePath string) error {
+	if chunkDownloaded(filePath, jobId, spec) {
+		fmt.Printf("%v: already downloaded.\n", spec.id)
+		return nil
+	}
 	fmt.Printf("%v: retrieve %v-%v\n", spec.id, spec.from, spec.to)
 
 	svc := glacier.New(m.AwsSession)
 
-	path, fileName := filepath.Split(filePath)
-	fn := filepath.Join(path, fmt.Sprintf("mars-%v_%03d.tmp", fileName, spec.id))
+	fn := chunkPath(filePath, spec.id)
+	hfn := chunkHashPath(filePath, spec.id)
+	os.Remove(hfn)
 
 	var jo glacier.GetJobOutputInput
 	jo.SetAccountId(m.Account).SetJobId(jobId).SetRange(fmt.Sprintf("bytes=%d-%d", spec.from, spec.to)).SetVaultName(m.Vault)
 
-	for {
+	var treeHash string
+	err := m.Retry.Do(logger, fmt.Sprintf("retrieve chunk %d", spec.id), func() error {
 		out, err := svc.GetJobOutput(&jo)
-		if err == nil {
-			err = doCopy(fn, out.Body)
-			if err == nil {
-				break
-			} else {
-				fmt.Printf("%d: copy failed.(%v) retry..\n", spec.id, err)
-				os.Remove(fn)
-				continue
-			}
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+
+		n, err := doCopy(fn, out.Body)
+		if err != nil {
+			return err
+		}
+		if n != spec.to-spec.from+1 {
+			return errors.Errorf("short chunk: %d/%d bytes", n, spec.to-spec.from+1)
+		}
+
+		// 1MB単位の範囲ならツリーハッシュが返ってくるので照合する
+		f, err := os.Open(fn)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()
+		h, err := backend.TreeHash(f)
+		if err != nil {
+			return err
+		}
+		treeHash = fmt.Sprintf("%x", h)
+		if expected := aws.StringValue(out.Checksum); expected != "" && expected != treeHash {
+			return errors.Errorf("tree hash mismatch: %s <-> %s", expected, treeHash)
 		}
-		fmt.Printf("%d : extract failed.(%v) retry..\n", spec.id, err)
+		return nil
+	})
+	if err != nil {
 		os.Remove(fn)
+		return err
+	}
+
+	err = ioutil.WriteFile(hfn, []byte(jobId+" "+treeHash+"\n"), 0644)
+	if err != nil {
+		return errors.WithStack(err)
 	}
 	fmt.Printf("%d: done.\n", spec.id)
+	return nil
 }
 
-func doCopy(fileName string, reader io.Reader) error {
+func doCopy(fileName string, reader io.Reader) (int64, error) {
 	f, err := os.Create(fileName)
 	if err != nil {
-		err = errors.WithStack(err)
-		return err
+		return 0, errors.WithStack(err)
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, reader)
-	return errors.WithStack(err)
+	n, err := io.Copy(f, reader)
+	return n, errors.WithStack(err)
 }
 
 func doAppend(writer *os.File, fileName string) (err error) {
@@ -0,0 +1,88 @@
+package glacier_manager
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"time"
+)
+
+// インベントリジョブ出力(JSON形式)
+type inventoryOutput struct {
+	VaultARN      string
+	InventoryDate string
+	ArchiveList   []struct {
+		ArchiveId          string
+		ArchiveDescription string
+		CreationDate       string
+		Size               int64
+		SHA256TreeHash     string
+	}
+}
+
+func (m *Manager) RequestInventory() (string, error) {
+	svc := glacier.New(m.AwsSession)
+
+	jobParam := glacier.JobParameters{
+		Format: aws.String("JSON"),
+		Type:   aws.String("inventory-retrieval"),
+	}
+	if m.SNSTopic != "" {
+		jobParam.SNSTopic = aws.String(m.SNSTopic)
+	}
+
+	jobInput := glacier.InitiateJobInput{
+		AccountId:     aws.String(m.Account),
+		JobParameters: &jobParam,
+		VaultName:     aws.String(m.Vault),
+	}
+
+	out, err := svc.InitiateJob(&jobInput)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return *out.JobId, nil
+}
+
+func (m *Manager) Inventory(jobId string) (*backend.Inventory, error) {
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		return nil, err
+	}
+	if !job.Completed {
+		return nil, ErrJobNotComplete
+	}
+
+	svc := glacier.New(m.AwsSession)
+
+	var jo glacier.GetJobOutputInput
+	jo.SetAccountId(m.Account).SetJobId(jobId).SetVaultName(m.Vault)
+
+	out, err := svc.GetJobOutput(&jo)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer out.Body.Close()
+
+	var inv inventoryOutput
+	err = json.NewDecoder(out.Body).Decode(&inv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &backend.Inventory{}
+	result.InventoryDate, _ = time.Parse(time.RFC3339, inv.InventoryDate)
+	for _, a := range inv.ArchiveList {
+		ct, _ := time.Parse(time.RFC3339, a.CreationDate)
+		result.Archives = append(result.Archives, backend.Archive{
+			ArchiveId:      a.ArchiveId,
+			Description:    a.ArchiveDescription,
+			CreationDate:   ct,
+			Size:           a.Size,
+			SHA256TreeHash: a.SHA256TreeHash,
+		})
+	}
+	return result, nil
+}
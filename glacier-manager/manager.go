@@ -2,29 +2,81 @@ package glacier_manager
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glacier"
 	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"time"
+)
+
+const (
+	jobDateLayout = "2006-01-02T15:04:05.999Z"
+)
+
+var (
+	_ backend.Backend       = (*Manager)(nil)
+	_ backend.TierEstimator = (*Manager)(nil)
 )
 
 type Manager struct {
 	Account, Vault, Region string
 
 	AwsSession *session.Session
+
+	// チャンク単位のアップロード/ダウンロードの再試行の方針
+	Retry backend.RetryPolicy
+
+	// ジョブの完了を通知するSNSトピックのARN。空なら通知しない
+	SNSTopic string
 }
 
 func New(account, vault, region string) (manager *Manager, err error) {
-	sess, err := session.NewSession(&aws.Config{
+	return NewWithEndpoint(account, vault, region, "")
+}
+
+/*
+endpointを指定するとそのURLに接続する(glaman emulate等での動作確認用)
+*/
+func NewWithEndpoint(account, vault, region, endpoint string) (manager *Manager, err error) {
+	cfg := &aws.Config{
 		Region: aws.String(region),
-	})
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+	sess, err := session.NewSession(cfg)
 	if err != nil {
 		return
 	}
-	manager = &Manager{account, vault, region, sess}
+	manager = &Manager{account, vault, region, sess, RetryPolicy(backend.DefaultRetryPolicy), ""}
 	return
 }
 
-func (m *Manager) DescribeJob(jobId string) (jobDesc *glacier.JobDescription, err error) {
+/*
+pにAWSのエラーの判定を設定したもの
+*/
+func RetryPolicy(p backend.RetryPolicy) backend.RetryPolicy {
+	p.Retryable = retryable
+	p.Throttled = request.IsErrorThrottle
+	return p
+}
+
+/*
+AWSのエラーはサーバ側の障害かSDKが再試行可能と判定したもの、それ以外(通信途中の切断など)は全て再試行する
+*/
+func retryable(err error) bool {
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() >= 500 {
+		return true
+	}
+	if _, ok := err.(awserr.Error); ok {
+		return request.IsErrorRetryable(err) || request.IsErrorThrottle(err)
+	}
+	return true
+}
+
+func (m *Manager) DescribeJob(jobId string) (*backend.Job, error) {
 	svc := glacier.New(m.AwsSession)
 
 	// ジョブ一覧取得
@@ -33,19 +85,44 @@ func (m *Manager) DescribeJob(jobId string) (jobDesc *glacier.JobDescription, er
 		SetJobId(jobId).
 		SetVaultName(m.Vault)
 
-	jobDesc, err = svc.DescribeJob(&ji)
-	return
+	jobDesc, err := svc.DescribeJob(&ji)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return toJob(jobDesc), nil
+}
+
+func (m *Manager) RequestRetrieve(archiveId, tier string) (string, error) {
+	return m.initiateRetrieval(archiveId, tier, "")
 }
 
-func (m *Manager) RequestRetrieve(archiveId string) (string, error) {
+/*
+アーカイブの一部の取得要求を出す
+
+Glacierの制約で、範囲は1MB境界から始まり、1MB境界の直前かアーカイブの末尾で終わること
+*/
+func (m *Manager) RequestRetrieveRange(archiveId, tier string, from, to int64) (string, error) {
+	if from%backend.RANGE_ALIGN != 0 {
+		return "", errors.Errorf("取得範囲の開始位置が1MB境界ではありません: %d", from)
+	}
+	return m.initiateRetrieval(archiveId, tier, backend.FormatRange(from, to))
+}
+
+func (m *Manager) initiateRetrieval(archiveId, tier, byteRange string) (string, error) {
 
 	svc := glacier.New(m.AwsSession)
 
 	jobParam := glacier.JobParameters{
 		ArchiveId: aws.String(archiveId),
-		Tier:      aws.String("Standard"),
+		Tier:      aws.String(tier),
 		Type:      aws.String("archive-retrieval"),
 	}
+	if byteRange != "" {
+		jobParam.RetrievalByteRange = aws.String(byteRange)
+	}
+	if m.SNSTopic != "" {
+		jobParam.SNSTopic = aws.String(m.SNSTopic)
+	}
 
 	jobInput := glacier.InitiateJobInput{
 		AccountId:     aws.String("-"),
@@ -61,7 +138,15 @@ func (m *Manager) RequestRetrieve(archiveId string) (string, error) {
 	return *out.JobId, nil
 }
 
-func (m *Manager) JobList() (jobDesc []*glacier.JobDescription, err error) {
+func (m *Manager) TierDurations() map[string]time.Duration {
+	return map[string]time.Duration{
+		backend.TIER_EXPEDITED: 5 * time.Minute,
+		backend.TIER_STANDARD:  5 * time.Hour,
+		backend.TIER_BULK:      12 * time.Hour,
+	}
+}
+
+func (m *Manager) JobList() ([]*backend.Job, error) {
 	svc := glacier.New(m.AwsSession)
 
 	ji := glacier.ListJobsInput{
@@ -73,5 +158,43 @@ func (m *Manager) JobList() (jobDesc []*glacier.JobDescription, err error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return out.JobList, nil
+
+	var jobs []*backend.Job
+	for _, j := range out.JobList {
+		jobs = append(jobs, toJob(j))
+	}
+	return jobs, nil
+}
+
+func (m *Manager) DeleteArchive(archiveId string) error {
+	svc := glacier.New(m.AwsSession)
+
+	var in glacier.DeleteArchiveInput
+	in.SetAccountId(m.Account).SetArchiveId(archiveId).SetVaultName(m.Vault)
+
+	_, err := svc.DeleteArchive(&in)
+	return errors.WithStack(err)
+}
+
+func toJob(jd *glacier.JobDescription) *backend.Job {
+	job := &backend.Job{
+		JobId:          aws.StringValue(jd.JobId),
+		Action:         aws.StringValue(jd.Action),
+		ArchiveId:      aws.StringValue(jd.ArchiveId),
+		StatusCode:     aws.StringValue(jd.StatusCode),
+		Tier:           aws.StringValue(jd.Tier),
+		Completed:      aws.BoolValue(jd.Completed),
+		ArchiveSize:    aws.Int64Value(jd.ArchiveSizeInBytes),
+		SHA256TreeHash: aws.StringValue(jd.SHA256TreeHash),
+
+		RetrievalByteRange: aws.StringValue(jd.RetrievalByteRange),
+	}
+	if jd.InventorySizeInBytes != nil {
+		job.ArchiveSize = *jd.InventorySizeInBytes
+	}
+	t, err := time.Parse(jobDateLayout, aws.StringValue(jd.CreationDate))
+	if err == nil {
+		job.CreationDate = t
+	}
+	return job
 }
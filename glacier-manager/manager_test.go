@@ -0,0 +1,308 @@
+package glacier_manager
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/glacier-emulator"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testVault = "test"
+
+var discard = log.New(ioutil.Discard, "", 0)
+
+/*
+glaman emulateと同じエミュレータを立ち上げ、それに接続するManagerを作る
+
+wrapを指定するとエミュレータへのリクエストをそれで包む。再試行はRetryだけで行うようにSDKの再試行は止める
+*/
+func newTestManager(t *testing.T, wrap func(http.Handler) http.Handler) (*Manager, func()) {
+	dir, err := ioutil.TempDir("", "glaman-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := glacier_emulator.New(glacier_emulator.Options{Dir: filepath.Join(dir, "emu"), Logger: discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h http.Handler = emu
+	if wrap != nil {
+		h = wrap(h)
+	}
+	srv := httptest.NewServer(h)
+	cleanup := func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "x")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "y")
+	m, err := NewWithEndpoint("-", testVault, "us-east-1", srv.URL)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	m.AwsSession.Config.MaxRetries = aws.Int(0)
+	m.Retry = RetryPolicy(backend.RetryPolicy{
+		MaxAttempts:   5,
+		BaseDelay:     time.Millisecond,
+		MaxDelay:      10 * time.Millisecond,
+		ThrottleDelay: time.Millisecond,
+	})
+
+	err = m.CreateVault(testVault)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return m, cleanup
+}
+
+// 複数のパート・ダウンロードのチャンクに分かれる大きさのデータ
+func testData() []byte {
+	data := make([]byte, DL_CHUNK_SIZE+DL_CHUNK_SIZE/4+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func uploadTestData(t *testing.T, m *Manager, data []byte) string {
+	archiveId, treeHash, err := m.Upload(discard, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	h, err := backend.TreeHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if treeHash != fmt.Sprintf("%x", h) {
+		t.Fatalf("tree hash = %s, want %x", treeHash, h)
+	}
+	return archiveId
+}
+
+/*
+ジョブの完了を確認してダウンロードし、中身を返す
+*/
+func retrieve(t *testing.T, m *Manager, jobId string) []byte {
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !job.Completed {
+		t.Fatalf("job %s is not completed: %s", jobId, job.StatusCode)
+	}
+
+	dir, err := ioutil.TempDir("", "glaman-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	err = m.DownloadFile(discard, jobId, out)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestUploadAndRetrieve(t *testing.T) {
+	m, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	data := testData()
+	archiveId := uploadTestData(t, m, data)
+
+	uploads, err := m.ListUploads()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(uploads) != 0 {
+		t.Errorf("%d uploads left after completion", len(uploads))
+	}
+
+	jobId, err := m.RequestRetrieve(archiveId, backend.TIER_STANDARD)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if job.ArchiveId != archiveId || job.ArchiveSize != int64(len(data)) || job.Tier != backend.TIER_STANDARD {
+		t.Errorf("job = %+v", job)
+	}
+
+	got := retrieve(t, m, jobId)
+	if !bytes.Equal(got, data) {
+		t.Errorf("retrieved %d bytes differ from uploaded %d bytes", len(got), len(data))
+	}
+}
+
+func TestRetrieveRange(t *testing.T) {
+	m, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	data := testData()
+	archiveId := uploadTestData(t, m, data)
+
+	for _, tt := range []struct {
+		from, to int64
+	}{
+		{0, backend.RANGE_ALIGN - 1},
+		{backend.RANGE_ALIGN, 3*backend.RANGE_ALIGN - 1},
+		// 末尾まで
+		{8 * backend.RANGE_ALIGN, int64(len(data)) - 1},
+	} {
+		jobId, err := m.RequestRetrieveRange(archiveId, backend.TIER_STANDARD, tt.from, tt.to)
+		if err != nil {
+			t.Fatalf("%d-%d: %+v", tt.from, tt.to, err)
+		}
+		got := retrieve(t, m, jobId)
+		if !bytes.Equal(got, data[tt.from:tt.to+1]) {
+			t.Errorf("%d-%d: retrieved %d bytes differ", tt.from, tt.to, len(got))
+		}
+	}
+
+	_, err := m.RequestRetrieveRange(archiveId, backend.TIER_STANDARD, 1, backend.RANGE_ALIGN-1)
+	if err == nil {
+		t.Error("unaligned range is accepted")
+	}
+}
+
+/*
+最初のn回のパートのアップロード・ジョブ出力の取得を、全てスロットリングするエミュレータに回す
+*/
+type throttler struct {
+	next, throttle http.Handler
+
+	mu sync.Mutex
+	n  int
+}
+
+func (h *throttler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chunk := (r.Method == "PUT" && strings.Contains(r.URL.Path, "/multipart-uploads/")) ||
+		(r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/output"))
+	h.mu.Lock()
+	throttled := chunk && h.n > 0
+	if throttled {
+		h.n--
+	}
+	h.mu.Unlock()
+
+	if throttled {
+		h.throttle.ServeHTTP(w, r)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *throttler) set(n int) {
+	h.mu.Lock()
+	h.n = n
+	h.mu.Unlock()
+}
+
+func TestThrottledChunksAreRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glaman-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	throttle, err := glacier_emulator.New(glacier_emulator.Options{Dir: dir, ThrottleRate: 1, Logger: discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const throttles = 3
+	th := &throttler{throttle: throttle}
+	m, cleanup := newTestManager(t, func(h http.Handler) http.Handler {
+		th.next = h
+		return th
+	})
+	defer cleanup()
+
+	data := testData()
+	before := backend.Stats()
+	th.set(throttles)
+	archiveId := uploadTestData(t, m, data)
+	after := backend.Stats()
+	if d := after.Throttles - before.Throttles; d != throttles {
+		t.Errorf("upload: %d throttles retried, want %d", d, throttles)
+	}
+
+	jobId, err := m.RequestRetrieve(archiveId, backend.TIER_STANDARD)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	th.set(throttles)
+	got := retrieve(t, m, jobId)
+	if !bytes.Equal(got, data) {
+		t.Errorf("retrieved %d bytes differ from uploaded %d bytes", len(got), len(data))
+	}
+	if d := backend.Stats().Throttles - after.Throttles; d != throttles {
+		t.Errorf("download: %d throttles retried, want %d", d, throttles)
+	}
+	if f := backend.Stats().Failures - before.Failures; f != 0 {
+		t.Errorf("%d failures", f)
+	}
+
+	// 再試行の回数を超えてスロットリングされたら失敗する
+	th.set(1000)
+	_, _, err = m.Upload(discard, bytes.NewReader(data))
+	if err == nil {
+		t.Error("upload succeeded while throttled")
+	}
+}
+
+func TestResumeWithInvalidPartSize(t *testing.T) {
+	m, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	// パートを1つアップロードした途中のアップロード
+	data := testData()
+	svc := glacier.New(m.AwsSession)
+	var initIn glacier.InitiateMultipartUploadInput
+	initIn.SetAccountId(m.Account).SetVaultName(m.Vault).SetPartSize(fmt.Sprintf("%d", MIN_PART_SIZE))
+	out, err := svc.InitiateMultipartUpload(&initIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := bytes.NewReader(data[:MIN_PART_SIZE])
+	var in glacier.UploadMultipartPartInput
+	in.SetAccountId(m.Account).SetVaultName(m.Vault).SetUploadId(*out.UploadId).
+		SetRange(fmt.Sprintf("bytes %d-%d/*", 0, MIN_PART_SIZE-1)).SetBody(part).
+		SetChecksum(fmt.Sprintf("%x", glacier.ComputeHashes(part).TreeHash))
+	_, err = svc.UploadMultipartPart(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// パートサイズが0以下の記録からは新しくアップロードし直す
+	for _, ps := range []int64{0, -1} {
+		state := backend.UploadState{UploadId: *out.UploadId, PartSize: ps}
+		archiveId, _, err := m.UploadResumable(discard, bytes.NewReader(data), state, nil)
+		if err != nil {
+			t.Fatalf("part size %d: %+v", ps, err)
+		}
+		if archiveId == "" {
+			t.Errorf("part size %d: no archive", ps)
+		}
+	}
+}
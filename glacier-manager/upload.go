@@ -1,24 +1,44 @@
 package glacier_manager
 
 import (
-	"bytes"
-	"crypto/sha256"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/glacier"
 	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
 	"io"
 	"log"
-	"os"
 	"sync"
+	"time"
 )
 
 const (
-	UPL_CHUNK_SIZE_MB = 8
-	ONE_MB            = 1024 * 1024
-	UPL_CHUNK_SIZE    = UPL_CHUNK_SIZE_MB * ONE_MB
-	NUM_UPL_GORUTINE  = 16
+	ONE_MB           = 1024 * 1024
+	MIN_PART_SIZE    = ONE_MB
+	MAX_PART_SIZE    = 4 * 1024 * ONE_MB
+	MAX_PARTS        = 10000
+	NUM_UPL_GORUTINE = 16
 )
 
+var ErrFileTooLarge = errors.New("File is too large to upload.")
+
+/*
+ファイルサイズに合わせたパートサイズ
+
+パート数がMAX_PARTS以内に収まる最小の2のべき乗(MIN_PART_SIZE〜MAX_PART_SIZE)を返す
+*/
+func PartSizeFor(size int64) (int64, error) {
+	for ps := int64(MIN_PART_SIZE); ps <= MAX_PART_SIZE; ps *= 2 {
+		if (size+ps-1)/ps <= MAX_PARTS {
+			return ps, nil
+		}
+	}
+	return 0, errors.WithStack(ErrFileTooLarge)
+}
+
+var _ backend.ResumableUploader = (*Manager)(nil)
+
 type chunkParam struct {
 	id         int
 	start, end int64
@@ -26,50 +46,108 @@ type chunkParam struct {
 }
 
 type chunkResult struct {
-	id   int
-	err  error
-	hash []byte
+	id    int
+	start int64
+	err   error
+	hash  []byte
 }
 
-func (m *Manager) UploadFile(logger *log.Logger, fileName string) (archiveId string, err error) {
+func (m *Manager) Upload(logger *log.Logger, src backend.Source) (archiveId, treeHash string, err error) {
+	return m.UploadResumable(logger, src, backend.UploadState{}, nil)
+}
 
-	fi2, err := os.Stat(fileName)
-	if err != nil {
-		err = errors.Cause(err)
-		return
-	}
-	size := fi2.Size()
+/*
+中断したアップロードを再開できるアップロード
+
+state.UploadIdが空なら新規にアップロードを開始する。そうでなければListPartsでアップロード済みのパートを確認し、
+残りのパートだけをアップロードする。storeがnilでなければ、開始したアップロードと完了したパートをstoreに記録する。
+storeがnilの場合は失敗時にアップロードを中止する
+*/
+func (m *Manager) UploadResumable(logger *log.Logger, src backend.Source, state backend.UploadState, store backend.UploadStore) (archiveId, treeHash string, err error) {
+
+	size := src.Size()
 
 	svc := glacier.New(m.AwsSession)
 
-	var initUplReq glacier.InitiateMultipartUploadInput
-	initUplReq.SetVaultName(m.Vault).SetAccountId(m.Account).SetPartSize(fmt.Sprintf("%d", UPL_CHUNK_SIZE))
+	if state.UploadId != "" && state.PartSize <= 0 {
+		// 記録が壊れていると再開できない(パートの位置が決まらない)
+		logger.Printf("Upload %v has invalid part size %d. Restart upload.\n", state.UploadId, state.PartSize)
+		state = backend.UploadState{}
+	}
 
-	initUplRes, err := svc.InitiateMultipartUpload(&initUplReq)
-	if err != nil {
-		err = errors.Cause(err)
-		return
+	// アップロード済みのパート
+	done := map[int64][]byte{}
+	if state.UploadId != "" {
+		done, err = m.listParts(state.UploadId, state.PartSize)
+		if err == errUploadNotFound {
+			logger.Printf("Upload %v is not found. Restart upload.\n", state.UploadId)
+			state = backend.UploadState{}
+			err = nil
+		} else if err != nil {
+			return
+		} else {
+			// 記録と食い違うパートはアップロードし直す
+			for start, h := range done {
+				if rec, ok := state.Parts[start]; ok && rec != fmt.Sprintf("%x", h) {
+					logger.Printf("Part %d: tree hash mismatch. Upload again.\n", start)
+					delete(done, start)
+				}
+			}
+			logger.Printf("Resume upload. uploadID=%v, %d parts uploaded\n", state.UploadId, len(done))
+		}
+	}
+
+	if state.UploadId == "" {
+		partSize, err2 := PartSizeFor(size)
+		if err2 != nil {
+			err = err2
+			return
+		}
+
+		var initUplReq glacier.InitiateMultipartUploadInput
+		initUplReq.SetVaultName(m.Vault).SetAccountId(m.Account).SetPartSize(fmt.Sprintf("%d", partSize))
+
+		initUplRes, err2 := svc.InitiateMultipartUpload(&initUplReq)
+		if err2 != nil {
+			err = errors.Cause(err2)
+			return
+		}
+		state = backend.UploadState{UploadId: *initUplRes.UploadId, PartSize: partSize}
+		logger.Printf("Initiate upload done. uploadID=%v, partSize=%d\n", state.UploadId, partSize)
+
+		if store != nil {
+			err = store.Init(state.UploadId, state.PartSize)
+			if err != nil {
+				return
+			}
+		}
 	}
-	uploadId := *initUplRes.UploadId
-	logger.Printf("Initiate upload done. uploadID=%v\n", uploadId)
+	uploadId := state.UploadId
+	partSize := state.PartSize
 
 	// パラメータ取得&キュー登録
 	var params []chunkParam
+	hashes := [][]byte{}
 	i := 0
-	for p := int64(0); p < size; p += UPL_CHUNK_SIZE {
-		pe := p + UPL_CHUNK_SIZE - 1
-		if pe > size {
+	for p := int64(0); p < size; p += partSize {
+		pe := p + partSize - 1
+		if pe >= size {
 			pe = size - 1
 		}
-		params = append(params, chunkParam{i, p, pe, logger})
+		if h, ok := done[p]; ok {
+			hashes = append(hashes, h)
+		} else {
+			hashes = append(hashes, nil)
+			params = append(params, chunkParam{i, p, pe, logger})
+		}
 		i++
 	}
-	q := make(chan chunkParam, i)
+	q := make(chan chunkParam, len(params))
 	for i = 0; i < len(params); i++ {
 		q <- params[i]
 	}
 	close(q)
-	logger.Printf("Num of chunks = %d", len(params))
+	logger.Printf("Num of chunks = %d (remaining %d)", len(hashes), len(params))
 
 	reschan := make(chan chunkResult, len(params))
 
@@ -77,34 +155,45 @@ func (m *Manager) UploadFile(logger *log.Logger, fileName string) (archiveId str
 	var wg sync.WaitGroup
 	for i := 0; i < NUM_UPL_GORUTINE; i++ {
 		wg.Add(1)
-		go func(q chan chunkParam, reschan chan chunkResult, fileName, uploadId string) {
+		go func(q chan chunkParam, reschan chan chunkResult, uploadId string) {
 			defer wg.Done()
 			for {
 				cp, ok := <-q
 				if !ok {
 					return
 				}
-				m.processChunk(fileName, uploadId, cp, reschan)
+				m.processChunk(src, uploadId, cp, reschan)
 
 			}
-		}(q, reschan, fileName, uploadId)
+		}(q, reschan, uploadId)
 	}
-	wg.Wait()
 
 	// 各goroutine結果チェック&ツリーハッシュ集約
+	// 完了したパートはその都度記録する
 	success := true
-	hashes := make([][]byte, len(params))
 	for i := 0; i < len(params); i++ {
 		res := <-reschan
 		if res.err != nil {
 			err = res.err
 			success = false
-			break
+			continue
 		}
 		hashes[res.id] = res.hash
+		if store != nil {
+			serr := store.Part(res.start, fmt.Sprintf("%x", res.hash))
+			if serr != nil {
+				err = serr
+				success = false
+			}
+		}
 	}
+	wg.Wait()
 
 	if !success {
+		if store != nil {
+			logger.Printf("Upload failed. Resume on next run. uploadID=%v\n", uploadId)
+			return
+		}
 		logger.Printf("Upload failed. Abort upload.\n")
 
 		var abortMUInput glacier.AbortMultipartUploadInput
@@ -114,13 +203,13 @@ func (m *Manager) UploadFile(logger *log.Logger, fileName string) (archiveId str
 		return
 	}
 
-	treeHash := glacier.ComputeTreeHash(hashes)
-	logger.Printf("Total hash: %x\n", treeHash)
+	treeHash = fmt.Sprintf("%x", glacier.ComputeTreeHash(hashes))
+	logger.Printf("Total hash: %s\n", treeHash)
 
 	// アップロード終了指示
 	var completeMUInput glacier.CompleteMultipartUploadInput
 	completeMUInput.SetAccountId(m.Account).SetVaultName(m.Vault).SetUploadId(uploadId).
-		SetChecksum(fmt.Sprintf("%x", treeHash)).SetArchiveSize(fmt.Sprintf("%d", size))
+		SetChecksum(treeHash).SetArchiveSize(fmt.Sprintf("%d", size))
 
 	archiveCreationOut, err := svc.CompleteMultipartUpload(&completeMUInput)
 	if err != nil {
@@ -133,67 +222,124 @@ func (m *Manager) UploadFile(logger *log.Logger, fileName string) (archiveId str
 	return
 }
 
-// チャンクのアップロード処理
-func (m *Manager) processChunk(fileName, uploadId string, cp chunkParam, reschan chan chunkResult) {
-	cp.logger.Printf("upload chunk %d\n", cp.id)
+var errUploadNotFound = errors.New("Upload is not found.")
 
-	f, _ := os.Open(fileName)
-	defer f.Close()
+/*
+アップロード済みのパートを取得する(開始位置 -> ツリーハッシュ)
+*/
+func (m *Manager) listParts(uploadId string, partSize int64) (map[int64][]byte, error) {
+	svc := glacier.New(m.AwsSession)
 
-	// チャンクの読み込み
-	_, err := f.Seek(cp.start, 0)
+	var in glacier.ListPartsInput
+	in.SetAccountId(m.Account).SetVaultName(m.Vault).SetUploadId(uploadId)
+
+	parts := map[int64][]byte{}
+	err := svc.ListPartsPages(&in, func(out *glacier.ListPartsOutput, last bool) bool {
+		for _, p := range out.Parts {
+			var start, end int64
+			_, err := fmt.Sscanf(aws.StringValue(p.RangeInBytes), "%d-%d", &start, &end)
+			if err != nil || start%partSize != 0 {
+				continue
+			}
+			var h []byte
+			_, err = fmt.Sscanf(aws.StringValue(p.SHA256TreeHash), "%x", &h)
+			if err != nil {
+				continue
+			}
+			parts[start] = h
+		}
+		return true
+	})
 	if err != nil {
-		err = errors.Wrapf(err, "%v", cp.id)
-		reschan <- chunkResult{cp.id, err, nil}
-		return
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException {
+			return nil, errUploadNotFound
+		}
+		return nil, errors.WithStack(err)
 	}
-	buf := make([]byte, UPL_CHUNK_SIZE)
-	n, err := io.ReadAtLeast(f, buf, int(cp.end-cp.start))
+	return parts, nil
+}
+
+// チャンクのアップロード処理
+func (m *Manager) processChunk(src backend.Source, uploadId string, cp chunkParam, reschan chan chunkResult) {
+	cp.logger.Printf("upload chunk %d\n", cp.id)
+
+	// チャンクはまとめてメモリに読み込まず、該当範囲を読みながら送る(パートは最大4GBになる)
+	body := io.NewSectionReader(src, cp.start, cp.end-cp.start+1)
+
+	// treehash計算
+	treeHash, err := backend.TreeHash(body)
 	if err != nil {
 		err = errors.Wrapf(err, "%v", cp.id)
-		reschan <- chunkResult{cp.id, err, nil}
+		reschan <- chunkResult{cp.id, cp.start, err, nil}
 		return
 	}
-
-	// treehash計算
-	hashes := [][]byte{}
-	for p := 0; p < n; p += ONE_MB {
-		pe := p + ONE_MB
-		if pe > n {
-			pe = n
-		}
-		tmpHash := sha256.Sum256(buf[p:pe])
-		hashes = append(hashes, tmpHash[:])
-	}
-	treeHash := glacier.ComputeTreeHash(hashes)
+	body.Seek(0, 0)
 
 	// Glacier UPL
 	svc := glacier.New(m.AwsSession)
 
 	var uplMPInput glacier.UploadMultipartPartInput
-	uplMPInput.SetAccountId(m.Account).SetBody(bytes.NewReader(buf[:n])).
+	uplMPInput.SetAccountId(m.Account).SetBody(body).
 		SetChecksum(fmt.Sprintf("%x", treeHash)).SetRange(fmt.Sprintf("bytes %v-%v/*", cp.start, cp.end)).
 		SetVaultName(m.Vault).SetUploadId(uploadId)
 
 	err = uplMPInput.Validate()
 	if err != nil {
 		err = errors.Cause(err)
-		reschan <- chunkResult{cp.id, err, nil}
+		reschan <- chunkResult{cp.id, cp.start, err, nil}
 		return
 	}
 
-	for {
-		_, err = svc.UploadMultipartPart(&uplMPInput)
-		if err == nil {
-			cp.logger.Printf("%v : Chunk upload done.", cp.id)
-			break
-		}
+	err = m.Retry.Do(cp.logger, fmt.Sprintf("upload chunk %d", cp.id), func() error {
+		uplMPInput.Body.Seek(0, 0)
+		_, err := svc.UploadMultipartPart(&uplMPInput)
+		return err
+	})
+	if err != nil {
+		reschan <- chunkResult{cp.id, cp.start, err, nil}
+		return
+	}
+	cp.logger.Printf("%v : Chunk upload done.", cp.id)
+
+	reschan <- chunkResult{cp.id, cp.start, nil, treeHash}
+}
 
-		cp.logger.Printf("%v : Chunk upload failed. Retry..(%v)\n", cp.id, err)
+var _ backend.MultipartLister = (*Manager)(nil)
 
-		uplMPInput.Body.Seek(0, 0)
+/*
+vaultに残っている未完了のアップロードを取得する
+*/
+func (m *Manager) ListUploads() ([]backend.MultipartUpload, error) {
+	svc := glacier.New(m.AwsSession)
 
+	var in glacier.ListMultipartUploadsInput
+	in.SetAccountId(m.Account).SetVaultName(m.Vault)
+
+	var uploads []backend.MultipartUpload
+	err := svc.ListMultipartUploadsPages(&in, func(out *glacier.ListMultipartUploadsOutput, last bool) bool {
+		for _, u := range out.UploadsList {
+			cd, _ := time.Parse(jobDateLayout, aws.StringValue(u.CreationDate))
+			uploads = append(uploads, backend.MultipartUpload{
+				UploadId:     aws.StringValue(u.MultipartUploadId),
+				Description:  aws.StringValue(u.ArchiveDescription),
+				CreationDate: cd,
+				PartSize:     aws.Int64Value(u.PartSizeInBytes),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
 	}
+	return uploads, nil
+}
+
+func (m *Manager) AbortUpload(uploadId string) error {
+	svc := glacier.New(m.AwsSession)
+
+	var in glacier.AbortMultipartUploadInput
+	in.SetAccountId(m.Account).SetVaultName(m.Vault).SetUploadId(uploadId)
 
-	reschan <- chunkResult{cp.id, nil, treeHash}
+	_, err := svc.AbortMultipartUpload(&in)
+	return errors.WithStack(err)
 }
@@ -0,0 +1,80 @@
+package glacier_manager
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	ErrVaultNotFound = errors.New("Vault is not found.")
+)
+
+type VaultInfo struct {
+	Name              string
+	CreationDate      time.Time
+	LastInventoryDate time.Time
+	NumberOfArchives  int64
+	SizeInBytes       int64
+}
+
+func (m *Manager) CreateVault(name string) error {
+	svc := glacier.New(m.AwsSession)
+
+	var in glacier.CreateVaultInput
+	in.SetAccountId(m.Account).SetVaultName(name)
+
+	_, err := svc.CreateVault(&in)
+	return errors.WithStack(err)
+}
+
+/*
+vaultの情報を取得する。存在しなければErrVaultNotFoundを返す
+*/
+func (m *Manager) DescribeVault(name string) (*VaultInfo, error) {
+	svc := glacier.New(m.AwsSession)
+
+	var in glacier.DescribeVaultInput
+	in.SetAccountId(m.Account).SetVaultName(name)
+
+	out, err := svc.DescribeVault(&in)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException {
+			return nil, ErrVaultNotFound
+		}
+		return nil, errors.WithStack(err)
+	}
+	return toVaultInfo(out.VaultName, out.CreationDate, out.LastInventoryDate, out.NumberOfArchives, out.SizeInBytes), nil
+}
+
+func (m *Manager) ListVaults() ([]VaultInfo, error) {
+	svc := glacier.New(m.AwsSession)
+
+	var in glacier.ListVaultsInput
+	in.SetAccountId(m.Account)
+
+	var vaults []VaultInfo
+	err := svc.ListVaultsPages(&in, func(out *glacier.ListVaultsOutput, last bool) bool {
+		for _, v := range out.VaultList {
+			vaults = append(vaults, *toVaultInfo(v.VaultName, v.CreationDate, v.LastInventoryDate, v.NumberOfArchives, v.SizeInBytes))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return vaults, nil
+}
+
+func toVaultInfo(name, creationDate, lastInventoryDate *string, numArchives, size *int64) *VaultInfo {
+	v := &VaultInfo{
+		Name:             aws.StringValue(name),
+		NumberOfArchives: aws.Int64Value(numArchives),
+		SizeInBytes:      aws.Int64Value(size),
+	}
+	v.CreationDate, _ = time.Parse(jobDateLayout, aws.StringValue(creationDate))
+	v.LastInventoryDate, _ = time.Parse(jobDateLayout, aws.StringValue(lastInventoryDate))
+	return v
+}
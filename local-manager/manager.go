@@ -0,0 +1,293 @@
+package local_manager
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	archiveDir = "archives"
+	jobDir     = "jobs"
+
+	actionRetrieval = "ArchiveRetrieval"
+	actionInventory = "InventoryRetrieval"
+
+	statusInProgress = "InProgress"
+	statusSucceeded  = "Succeeded"
+
+	// 完了したジョブの出力を取得できる期間(Glacierと同じ24時間)
+	JOB_LIFETIME = 24 * time.Hour
+)
+
+var _ backend.Backend = (*Manager)(nil)
+
+/*
+ローカル(またはNAS)のディレクトリを保存先とするバックエンド
+
+Glacierと同様に取得要求からDelay経過後にジョブが完了となり、完了からJOB_LIFETIME経過すると期限切れになる
+*/
+type Manager struct {
+	Dir   string
+	Delay time.Duration
+}
+
+// ジョブファイルの内容
+type jobFile struct {
+	JobId        string
+	Action       string
+	ArchiveId    string
+	CreationDate time.Time
+	ReadyDate    time.Time
+}
+
+func New(dir string, delay time.Duration) (*Manager, error) {
+	for _, d := range []string{archiveDir, jobDir} {
+		err := os.MkdirAll(filepath.Join(dir, d), 0755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return &Manager{dir, delay}, nil
+}
+
+func (m *Manager) Upload(logger *log.Logger, src backend.Source) (string, string, error) {
+	archiveId, err := newId()
+	if err != nil {
+		return "", "", err
+	}
+
+	dst := m.archivePath(archiveId)
+	th := backend.NewTreeHasher()
+	err = writeFile(dst+".tmp", io.TeeReader(io.NewSectionReader(src, 0, src.Size()), th))
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return "", "", err
+	}
+	err = os.Rename(dst+".tmp", dst)
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	logger.Printf("Upload success. archiveId=%v\n", archiveId)
+	return archiveId, th.String(), nil
+}
+
+func (m *Manager) RequestRetrieve(archiveId, tier string) (string, error) {
+	_, err := os.Stat(m.archivePath(archiveId))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return m.newJob(actionRetrieval, archiveId)
+}
+
+/*
+期限切れのジョブ(JobListで削除済みのものを含む)はErrJobExpiredを返す
+*/
+func (m *Manager) DescribeJob(jobId string) (*backend.Job, error) {
+	jf, err := m.readJob(jobId)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, backend.ErrJobExpired
+	} else if err != nil {
+		return nil, err
+	}
+	if jf.expired(time.Now()) {
+		return nil, backend.ErrJobExpired
+	}
+	return m.toJob(jf), nil
+}
+
+/*
+期限切れのジョブのファイルは削除する。読めないファイルは無視する
+*/
+func (m *Manager) JobList() ([]*backend.Job, error) {
+	files, err := ioutil.ReadDir(filepath.Join(m.Dir, jobDir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	now := time.Now()
+	var jobs []*backend.Job
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		jf, err := m.readJob(fi.Name()[:len(fi.Name())-len(".json")])
+		if err != nil {
+			continue
+		}
+		if jf.expired(now) {
+			os.Remove(m.jobPath(jf.JobId))
+			continue
+		}
+		jobs = append(jobs, m.toJob(jf))
+	}
+	return jobs, nil
+}
+
+func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) error {
+	logger.Printf("check job %s", filePath)
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		return err
+	}
+	if !job.Completed {
+		return backend.ErrJobNotComplete
+	}
+	logger.Printf("Retrieve job %s", filePath)
+
+	path, _ := filepath.Split(filePath)
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return copyFile(filePath, m.archivePath(job.ArchiveId))
+}
+
+func (m *Manager) DeleteArchive(archiveId string) error {
+	err := os.Remove(m.archivePath(archiveId))
+	return errors.WithStack(err)
+}
+
+func (m *Manager) RequestInventory() (string, error) {
+	return m.newJob(actionInventory, "")
+}
+
+func (m *Manager) Inventory(jobId string) (*backend.Inventory, error) {
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		return nil, err
+	}
+	if !job.Completed {
+		return nil, backend.ErrJobNotComplete
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(m.Dir, archiveDir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	inv := &backend.Inventory{InventoryDate: time.Now()}
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) == ".tmp" {
+			continue
+		}
+		inv.Archives = append(inv.Archives, backend.Archive{
+			ArchiveId:    fi.Name(),
+			CreationDate: fi.ModTime(),
+			Size:         fi.Size(),
+		})
+	}
+	return inv, nil
+}
+
+func (m *Manager) archivePath(archiveId string) string {
+	return filepath.Join(m.Dir, archiveDir, archiveId)
+}
+
+func (m *Manager) jobPath(jobId string) string {
+	return filepath.Join(m.Dir, jobDir, jobId+".json")
+}
+
+func (m *Manager) newJob(action, archiveId string) (string, error) {
+	jobId, err := newId()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = m.writeJob(&jobFile{jobId, action, archiveId, now, now.Add(m.Delay)})
+	if err != nil {
+		return "", err
+	}
+	return jobId, nil
+}
+
+func (m *Manager) writeJob(jf *jobFile) error {
+	data, err := json.Marshal(jf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(m.jobPath(jf.JobId), data, 0644))
+}
+
+func (m *Manager) readJob(jobId string) (*jobFile, error) {
+	data, err := ioutil.ReadFile(m.jobPath(jobId))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var jf jobFile
+	err = json.Unmarshal(data, &jf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &jf, nil
+}
+
+func (jf *jobFile) expired(now time.Time) bool {
+	return !now.Before(jf.ReadyDate.Add(JOB_LIFETIME))
+}
+
+func (m *Manager) toJob(jf *jobFile) *backend.Job {
+	job := &backend.Job{
+		JobId:        jf.JobId,
+		Action:       jf.Action,
+		ArchiveId:    jf.ArchiveId,
+		StatusCode:   statusInProgress,
+		Tier:         "Local",
+		CreationDate: jf.CreationDate,
+	}
+	if !time.Now().Before(jf.ReadyDate) {
+		job.Completed = true
+		job.StatusCode = statusSucceeded
+	}
+	if jf.ArchiveId != "" {
+		fi, err := os.Stat(m.archivePath(jf.ArchiveId))
+		if err == nil {
+			job.ArchiveSize = fi.Size()
+		}
+	}
+	return job
+}
+
+func newId() (string, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	return writeFile(dst, in)
+}
+
+func writeFile(dst string, in io.Reader) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(out.Sync())
+}
@@ -0,0 +1,126 @@
+package local_manager
+
+import (
+	"bytes"
+	"github.com/rami1942/glaman/backend"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDelay = 100 * time.Millisecond
+
+func newTestManager(t *testing.T) (*Manager, string, func()) {
+	dir, err := ioutil.TempDir("", "glaman-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(filepath.Join(dir, "store"), testDelay)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return m, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestDownloadAfterDelay(t *testing.T) {
+	m, dir, cleanup := newTestManager(t)
+	defer cleanup()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	data := []byte("local archive")
+	archiveId, _, err := m.Upload(logger, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	jobId, err := m.RequestRetrieve(archiveId, backend.TIER_STANDARD)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	out := filepath.Join(dir, "out", "a.txt")
+	err = m.DownloadFile(logger, jobId, out)
+	if err != backend.ErrJobNotComplete {
+		t.Fatalf("before delay: err = %v, want ErrJobNotComplete", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("before delay: %s is created", out)
+	}
+
+	time.Sleep(testDelay)
+	err = m.DownloadFile(logger, jobId, out)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %q, want %q", got, data)
+	}
+}
+
+func TestExpiredJob(t *testing.T) {
+	m, dir, cleanup := newTestManager(t)
+	defer cleanup()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	archiveId, _, err := m.Upload(logger, bytes.NewReader([]byte("old")))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	jobId, err := m.RequestRetrieve(archiveId, backend.TIER_STANDARD)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// 完了からJOB_LIFETIMEが過ぎたことにする
+	jf, err := m.readJob(jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	jf.ReadyDate = time.Now().Add(-JOB_LIFETIME - time.Minute)
+	jf.CreationDate = jf.ReadyDate
+	err = m.writeJob(jf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	_, err = m.DescribeJob(jobId)
+	if err != backend.ErrJobExpired {
+		t.Errorf("DescribeJob: err = %v, want ErrJobExpired", err)
+	}
+	err = m.DownloadFile(logger, jobId, filepath.Join(dir, "out"))
+	if err != backend.ErrJobExpired {
+		t.Errorf("DownloadFile: err = %v, want ErrJobExpired", err)
+	}
+
+	// 読めないファイルがあってもJobListは失敗しない
+	err = ioutil.WriteFile(m.jobPath("broken"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveId, err := m.RequestRetrieve(archiveId, backend.TIER_STANDARD)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	jobs, err := m.JobList()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(jobs) != 1 || jobs[0].JobId != liveId {
+		t.Errorf("jobs = %+v, want only %s", jobs, liveId)
+	}
+	if _, err := os.Stat(m.jobPath(jobId)); !os.IsNotExist(err) {
+		t.Errorf("expired job file is not removed")
+	}
+	// 削除した後も期限切れとして扱う
+	_, err = m.DescribeJob(jobId)
+	if err != backend.ErrJobExpired {
+		t.Errorf("after removal: err = %v, want ErrJobExpired", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"os"
+	"github.com/rami1942/glaman/model"
 	"github.com/rami1942/glaman/subcmd"
 	"github.com/rami1942/glaman/util"
 )
@@ -18,10 +19,14 @@ var (
 
 	scmdNew  = app.Command("newdb", "インデックスDBの新規作成")
 	sNewName = scmdNew.Arg("dbname", "インデックスDB名").Default(home + "/Documents/glaman.sqlite3").String()
-	sNewRegion = scmdNew.Flag("region", "リージョン").Required().String()
-	sNewVault = scmdNew.Flag("vault", "Vault名").Required().String()
+	sNewRegion = scmdNew.Flag("region", "リージョン").String()
+	sNewVault = scmdNew.Flag("vault", "Vault名(backend=s3, gcsの場合はバケット名)").String()
 	sNewBaseDir = scmdNew.Flag("basedir", "同期対象ディレクトリ").Required().ExistingDir()
 	sNewPassword = scmdNew.Flag("password", "パスワード").Required().String()
+	sNewBackend = scmdNew.Flag("backend", "保存先(glacier, local, s3, gcs)").Default("glacier").String()
+	sNewLocalDir = scmdNew.Flag("localdir", "保存先ディレクトリ(backend=localの場合)").String()
+	sNewEndpoint = scmdNew.Flag("endpoint", "接続先URL").String()
+	sNewCreateVault = scmdNew.Flag("create-vault", "vaultが無ければ確認せずに作成").Bool()
 
 
 	scmdLs     = app.Command("ls", "アーカイブファイル一覧")
@@ -48,11 +53,94 @@ var (
 
 	scmdLock = app.Command("lock", "ファイルのロック")
 	sLockIds = scmdLock.Arg("id", "エントリID").Int64List()
+	sLockTier = scmdLock.Flag("tier", "取得の速さ(expedited, standard, bulk)").String()
+	sLockNeedBy = scmdLock.Flag("need-by", "取得完了の期限(6h, 2006/01/02 15:04等)。間に合う最も安いティアを選ぶ").String()
 
 	scmdUnlock = app.Command("unlock", "ファイルのアンロック")
 	sUnlockIds = scmdUnlock.Arg("id", "エントリID").Int64List()
 
+	scmdPeek   = app.Command("peek", "ファイルの一部の取得")
+	sPeekId    = scmdPeek.Arg("id", "エントリID").Required().Int64()
+	sPeekRange = scmdPeek.Arg("range", "取得する範囲(0-100M, 2G-等。両端を含む)").Required().String()
+	sPeekOut   = scmdPeek.Flag("out", "出力先(省略時はカレントディレクトリの<ファイル名>.<from>-<to>)").Short('o').String()
+	sPeekTier  = scmdPeek.Flag("tier", "取得の速さ(expedited, standard, bulk)").String()
+
+	scmdVersions  = app.Command("versions", "ファイルの版の一覧")
+	sVersionsPath = scmdVersions.Arg("path", "ファイルのパス(ベースディレクトリからの相対パス)").Required().String()
+
+	scmdRestore     = app.Command("restore", "ファイルの特定の版の取得")
+	sRestorePath    = scmdRestore.Arg("path", "ファイルのパス(ベースディレクトリからの相対パス)").Required().String()
+	sRestoreVersion = scmdRestore.Flag("version", "版番号(glaman versionsの1列目)").Int()
+	sRestoreAt      = scmdRestore.Flag("at", "その日時の版を取得する(2006/01/02 15:04等。6hなら6時間前)").String()
+	sRestoreOut     = scmdRestore.Flag("out", "出力先(省略時はカレントディレクトリの<ファイル名>.v<版番号>)").Short('o').String()
+	sRestoreTier    = scmdRestore.Flag("tier", "取得の速さ(expedited, standard, bulk)").String()
+
 	scmdClean = app.Command("clean", "アンロックファイルの削除")
+
+	scmdDest         = app.Command("dest", "保存先の管理")
+	scmdDestLs       = scmdDest.Command("ls", "保存先一覧")
+	scmdDestAdd      = scmdDest.Command("add", "保存先の追加")
+	sDestAddName     = scmdDestAdd.Arg("name", "保存先名").Required().String()
+	sDestAddBackend  = scmdDestAdd.Flag("backend", "保存先(glacier, local, s3, gcs)").Required().String()
+	sDestAddRegion   = scmdDestAdd.Flag("region", "リージョン").String()
+	sDestAddVault    = scmdDestAdd.Flag("vault", "Vault名またはバケット名").String()
+	sDestAddLocalDir = scmdDestAdd.Flag("localdir", "保存先ディレクトリ(backend=localの場合)").String()
+	sDestAddDelay    = scmdDestAdd.Flag("localdelay", "取得までの待ち時間(backend=localの場合)").String()
+	sDestAddClass    = scmdDestAdd.Flag("storageclass", "ストレージクラス(backend=s3, gcsの場合)").String()
+	sDestAddEndpoint = scmdDestAdd.Flag("endpoint", "接続先URL").String()
+	sDestAddCost     = scmdDestAdd.Flag("cost", "取得時の優先順位(小さいほど優先)").Default("-1").Int()
+	scmdDestRm       = scmdDest.Command("rm", "保存先の削除")
+	sDestRmName      = scmdDestRm.Arg("name", "保存先名").Required().String()
+
+	scmdEmulate       = app.Command("emulate", "Glacier APIエミュレータの起動")
+	sEmulateAddr      = scmdEmulate.Flag("listen", "待ち受けアドレス").Default("127.0.0.1:8910").String()
+	sEmulateDir       = scmdEmulate.Flag("dir", "データ保存先ディレクトリ").Required().ExistingDir()
+	sEmulateDelay     = scmdEmulate.Flag("delay", "ジョブ完了までの時間").Default("0s").Duration()
+	sEmulateFail      = scmdEmulate.Flag("fail-rate", "パートのアップロード/ダウンロードが失敗する確率(0-1)").Default("0").Float64()
+	sEmulateThrottle  = scmdEmulate.Flag("throttle-rate", "スロットリングされる確率(0-1)").Default("0").Float64()
+
+	scmdInventory = app.Command("inventory", "インベントリの取得とカタログとの突き合わせ")
+	sInventoryDest = scmdInventory.Flag("dest", "保存先名").Default("default").String()
+	sInventoryFix  = scmdInventory.Flag("fix", "修正する項目(catalog: カタログにのみ存在, vault: vaultにのみ存在, size: サイズ不一致)").Enums("catalog", "vault", "size")
+
+	scmdRm      = app.Command("rm", "アーカイブの削除")
+	sRmSelector = scmdRm.Arg("selector", "エントリIDまたはパス(ワイルドカード可)").Required().Strings()
+	sRmDoRun    = scmdRm.Flag("run", "実際に削除する").Short('r').Bool()
+
+	scmdVault         = app.Command("vault", "vaultの管理")
+	scmdVaultCreate   = scmdVault.Command("create", "vaultの作成")
+	sVaultCreateName  = scmdVaultCreate.Arg("name", "vault名(省略時は設定のvault)").String()
+	scmdVaultList     = scmdVault.Command("list", "vault一覧")
+	scmdVaultDescribe = scmdVault.Command("describe", "vaultの情報")
+	sVaultDescName    = scmdVaultDescribe.Arg("name", "vault名(省略時は設定のvault)").String()
+
+	scmdUploads      = app.Command("uploads", "未完了のアップロードの管理")
+	sUploadsDest     = scmdUploads.Flag("dest", "保存先名").Default("default").String()
+	scmdUploadsLs    = scmdUploads.Command("ls", "未完了のアップロード一覧")
+	scmdUploadsAbort = scmdUploads.Command("abort", "アップロードの中止")
+	sUploadsAbortIds = scmdUploadsAbort.Arg("uploadid", "アップロードID").Required().Strings()
+	scmdUploadsGc    = scmdUploads.Command("gc", "孤立したアップロードの中止")
+	sUploadsGcOlder  = scmdUploadsGc.Flag("older-than", "これより古いものだけを中止する").Default("24h").Duration()
+	sUploadsGcDoRun  = scmdUploadsGc.Flag("run", "実際に中止する").Short('r').Bool()
+
+	scmdWait      = app.Command("wait", "取得ジョブの完了を待って取得")
+	sWaitInterval = scmdWait.Flag("interval", "ジョブの状態を確認する間隔").Default("10m").Duration()
+	sWaitTimeout  = scmdWait.Flag("timeout", "これを過ぎたら待つのをやめる(0なら無制限)").Default("0s").Duration()
+
+	scmdWatch   = app.Command("watch", "同期対象ディレクトリを監視して新しいファイルをアップロード")
+	sWatchQuiet = scmdWatch.Flag("quiet", "ファイルの変更が止まってから登録するまでの時間").Default("30s").Duration()
+	sWatchDoRun = scmdWatch.Flag("run", "実際の処理を実行").Short('r').Bool()
+
+	scmdDaemon    = app.Command("daemon", "常駐して同期・取得・削除を定期的に実行")
+	sDaemonStatus = scmdDaemon.Flag("status-file", "状態ファイル(省略時は<DB名>.status)").String()
+
+	scmdListen  = app.Command("listen", "SNSのジョブ完了通知を待ち受けて取得")
+	sListenAddr = scmdListen.Flag("listen", "待ち受けアドレス").Default(":8920").String()
+	sListenCert = scmdListen.Flag("cert", "署名の確認に使う証明書(PEM)。省略時はSigningCertURLから取得").ExistingFile()
+
+	scmdConfig   = app.Command("config", "設定の参照/変更")
+	sConfigKey   = scmdConfig.Arg("key", "設定名").String()
+	sConfigValue = scmdConfig.Arg("value", "設定値").String()
 )
 
 func main() {
@@ -60,7 +148,14 @@ func main() {
 
 	pv := kingpin.MustParse(app.Parse(os.Args[1:]))
 	if pv == scmdNew.FullCommand() {
-		err := subcmd.NewDB(logger, *sNewName, *sNewRegion, *sNewVault, *sNewBaseDir, *sNewPassword)
+		err := subcmd.NewDB(logger, *sNewName, *sNewRegion, *sNewVault, *sNewBaseDir, *sNewPassword, *sNewBackend, *sNewLocalDir, *sNewEndpoint, *sNewCreateVault)
+		if err != nil {
+			logger.Printf("%+v\n", err)
+		}
+		return
+	}
+	if pv == scmdEmulate.FullCommand() {
+		err := subcmd.Emulate(logger, *sEmulateAddr, *sEmulateDir, *sEmulateDelay, *sEmulateFail, *sEmulateThrottle)
 		if err != nil {
 			logger.Printf("%+v\n", err)
 		}
@@ -95,9 +190,61 @@ func main() {
 	case scmdClean.FullCommand():
 		err = subcmd.Clean(cfg)
 	case scmdLock.FullCommand():
-		err = subcmd.Lock(cfg, *sLockIds, 1)
+		err = subcmd.Lock(cfg, *sLockIds, 1, *sLockTier, *sLockNeedBy)
 	case scmdUnlock.FullCommand():
-		err = subcmd.Lock(cfg, *sUnlockIds, 0)
+		err = subcmd.Lock(cfg, *sUnlockIds, 0, "", "")
+	case scmdPeek.FullCommand():
+		err = subcmd.Peek(cfg, *sPeekId, *sPeekRange, *sPeekOut, *sPeekTier)
+	case scmdVersions.FullCommand():
+		err = subcmd.Versions(cfg, *sVersionsPath)
+	case scmdRestore.FullCommand():
+		err = subcmd.Restore(cfg, *sRestorePath, *sRestoreVersion, *sRestoreAt, *sRestoreOut, *sRestoreTier)
+	case scmdDestLs.FullCommand():
+		err = subcmd.DestList(cfg)
+	case scmdDestAdd.FullCommand():
+		err = subcmd.DestAdd(cfg, model.Destination{
+			Name:         *sDestAddName,
+			Backend:      *sDestAddBackend,
+			Region:       *sDestAddRegion,
+			Vault:        *sDestAddVault,
+			LocalDir:     *sDestAddLocalDir,
+			LocalDelay:   *sDestAddDelay,
+			StorageClass: *sDestAddClass,
+			Endpoint:     *sDestAddEndpoint,
+			Cost:         *sDestAddCost,
+		})
+	case scmdDestRm.FullCommand():
+		err = subcmd.DestRemove(cfg, *sDestRmName)
+	case scmdInventory.FullCommand():
+		err = subcmd.Inventory(cfg, *sInventoryDest, *sInventoryFix)
+	case scmdRm.FullCommand():
+		err = subcmd.Rm(cfg, *sRmSelector, *sRmDoRun)
+	case scmdVaultCreate.FullCommand():
+		err = subcmd.VaultCreate(cfg, *sVaultCreateName)
+	case scmdVaultList.FullCommand():
+		err = subcmd.VaultList(cfg)
+	case scmdVaultDescribe.FullCommand():
+		err = subcmd.VaultDescribe(cfg, *sVaultDescName)
+	case scmdUploadsLs.FullCommand():
+		err = subcmd.UploadsList(cfg, *sUploadsDest)
+	case scmdUploadsAbort.FullCommand():
+		err = subcmd.UploadsAbort(cfg, *sUploadsDest, *sUploadsAbortIds)
+	case scmdUploadsGc.FullCommand():
+		err = subcmd.UploadsGc(cfg, *sUploadsDest, *sUploadsGcOlder, *sUploadsGcDoRun)
+	case scmdWait.FullCommand():
+		err = subcmd.Wait(cfg, *sWaitInterval, *sWaitTimeout)
+	case scmdWatch.FullCommand():
+		err = subcmd.Watch(cfg, *sWatchQuiet, *sWatchDoRun)
+	case scmdDaemon.FullCommand():
+		statusFile := *sDaemonStatus
+		if statusFile == "" {
+			statusFile = *goptDBName + ".status"
+		}
+		err = subcmd.Daemon(cfg, statusFile)
+	case scmdListen.FullCommand():
+		err = subcmd.Listen(cfg, *sListenAddr, *sListenCert)
+	case scmdConfig.FullCommand():
+		err = subcmd.Config(cfg, *sConfigKey, *sConfigValue)
 	}
 
 	if err != nil {
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	// configテーブルの設定で表される保存先の名前
+	DEFAULT_DESTINATION = "default"
+)
+
+/*
+アーカイブの保存先
+
+Costは取得時の優先順位で、小さいものから使う
+*/
+type Destination struct {
+	Id           int64
+	Name         string
+	Backend      string
+	Region       string
+	Vault        string
+	LocalDir     string
+	LocalDelay   string
+	StorageClass string
+	Endpoint     string
+	Cost         int
+}
+
+const destinationColumns = "id, name, backend, region, vault, local_dir, local_delay, storage_class, endpoint, cost"
+
+func scanDestination(row scanRow) (*Destination, error) {
+	var d Destination
+	err := row.Scan(&d.Id, &d.Name, &d.Backend, &d.Region, &d.Vault, &d.LocalDir, &d.LocalDelay, &d.StorageClass, &d.Endpoint, &d.Cost)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &d, nil
+}
+
+func AllDestinations(db *sql.DB) ([]Destination, error) {
+	rows, err := db.Query("select " + destinationColumns + " from destination order by cost, id")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var dests []Destination
+	for rows.Next() {
+		d, err := scanDestination(rows)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, *d)
+	}
+	return dests, nil
+}
+
+func FindDestinationByName(db *sql.DB, name string) (*Destination, error) {
+	d, err := scanDestination(db.QueryRow("select "+destinationColumns+" from destination where name=?", name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+func InsertDestination(db *sql.DB, d Destination) error {
+	_, err := db.Exec(`insert into destination (name, backend, region, vault, local_dir, local_delay, storage_class, endpoint, cost)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.Name, d.Backend, d.Region, d.Vault, d.LocalDir, d.LocalDelay, d.StorageClass, d.Endpoint, d.Cost)
+	return errors.WithStack(err)
+}
+
+func DeleteDestination(db *sql.DB, name string) error {
+	_, err := db.Exec("delete from destination where name=?", name)
+	return errors.WithStack(err)
+}
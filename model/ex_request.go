@@ -7,28 +7,68 @@ import (
 )
 
 type ExRequest struct {
-	Id      int64
-	JobId   string
-	StartDt time.Time
+	Id          int64
+	JobId       string
+	StartDt     time.Time
+	Destination string
+	Tier        string
 }
 
 func FindExRequestById(db *sql.DB, id int64) (*ExRequest, error) {
-	var jobId string
+	var jobId, dest, tier string
 	var sd int64
 
-	err := db.QueryRow("select job_id, start_dt from ex_request where id=?", id).Scan(&jobId, &sd)
+	err := db.QueryRow("select job_id, start_dt, destination, tier from ex_request where id=?", id).Scan(&jobId, &sd, &dest, &tier)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	t := time.Unix(0, sd)
-	return &ExRequest{id, jobId, t}, nil
+	return &ExRequest{id, jobId, t, dest, tier}, nil
 }
 
-func InsertRequest(db *sql.DB, id int64, jobId string) error {
+/*
+ジョブIDから取得要求を探す(SNSの完了通知用)
+*/
+func FindExRequestByJobId(db *sql.DB, jobId string) (*ExRequest, error) {
+	ex := ExRequest{JobId: jobId}
+	var sd int64
+
+	err := db.QueryRow("select id, start_dt, destination, tier from ex_request where job_id=?", jobId).Scan(&ex.Id, &sd, &ex.Destination, &ex.Tier)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ex.StartDt = time.Unix(0, sd)
+	return &ex, nil
+}
+
+func AllRequests(db *sql.DB) ([]ExRequest, error) {
+	rows, err := db.Query("select id, job_id, start_dt, destination, tier from ex_request order by start_dt")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var requests []ExRequest
+	for rows.Next() {
+		var ex ExRequest
+		var sd int64
+		err = rows.Scan(&ex.Id, &ex.JobId, &sd, &ex.Destination, &ex.Tier)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		ex.StartDt = time.Unix(0, sd)
+		requests = append(requests, ex)
+	}
+	return requests, nil
+}
+
+func InsertRequest(db *sql.DB, id int64, jobId, dest, tier string) error {
 	t := time.Now()
-	_, err := db.Exec("insert into ex_request (id, job_id, start_dt) values (?, ?, ?)", id, jobId, t.UnixNano())
+	_, err := db.Exec("insert into ex_request (id, job_id, start_dt, destination, tier) values (?, ?, ?, ?, ?)", id, jobId, t.UnixNano(), dest, tier)
 	return errors.WithStack(err)
 }
 
@@ -4,24 +4,45 @@ import (
 	"crypto/aes"
 	"database/sql"
 	"github.com/pkg/errors"
+	"time"
 )
 
+/*
+保存した内容(file_entry)とそのパス(file_path)の組
+
+同じ内容のファイルが複数のパスにあれば、アーカイブは1つでパスごとにエントリを返す。
+Name, Mtime, Lockはパスごとの値で、パスの無い古い版は登録時の値
+*/
 type FileEntry struct {
 	Id        int64
 	Name      string
 	MD5Sum    string
+	SHA256    string
 	Mtime     int64
 	Size      int64
 	ArchiveId string
 	Lock      int
 
+	// 前の版のエントリID(最初の版なら0)
+	PrevId int64
+	// 新しい版に置き換えられた日時(UnixNano)。現在の版なら0
+	ReplacedDt int64
+
+	// file_pathのid。パスの無い古い版なら0
+	PathId int64
+
 	Comment string
 }
 
 const (
-	fromClause            = "select id, name, md5sum, mtime, size, archive_id, lock from file_entry"
-	fromClauseWithComment = `select e.id, e.name, e.md5sum, e.mtime, e.size, e.archive_id, e.lock, c.comment from file_entry e
+	columns = `e.id, coalesce(p.name, e.name), e.md5sum, e.sha256, coalesce(p.mtime, e.mtime), e.size, e.archive_id,
+			coalesce(p.lock, e.lock), e.prev_id, e.replaced_dt, coalesce(p.id, 0)`
+	fromClause            = "select " + columns + " from file_entry e left join file_path p on p.entry_id = e.id"
+	fromClauseWithComment = "select " + columns + `, c.comment from file_entry e left join file_path p on p.entry_id = e.id
 			left join comments c on e.id = c.id`
+
+	// パスのある(現在の版の)エントリだけ
+	currentOnly = "p.id is not null"
 )
 
 type scanRow interface {
@@ -30,11 +51,12 @@ type scanRow interface {
 
 func scan(row scanRow) (entry *FileEntry, err error) {
 	var id int64
-	var name, md5sum, archiveId string
-	var mtime, size int64
+	var name, md5sum, sha256 string
+	var archiveId sql.NullString
+	var mtime, size, prevId, replacedDt, pathId int64
 	var lock int
 
-	err = row.Scan(&id, &name, &md5sum, &mtime, &size, &archiveId, &lock)
+	err = row.Scan(&id, &name, &md5sum, &sha256, &mtime, &size, &archiveId, &lock, &prevId, &replacedDt, &pathId)
 	if err == sql.ErrNoRows {
 		return nil, err
 	}
@@ -42,19 +64,21 @@ func scan(row scanRow) (entry *FileEntry, err error) {
 		return nil, errors.WithStack(err)
 	}
 
-	entry = &FileEntry{id, name, md5sum, mtime, size, archiveId, lock, ""}
+	// アップロードが終わっていないエントリのarchive_idはnull
+	entry = &FileEntry{id, name, md5sum, sha256, mtime, size, archiveId.String, lock, prevId, replacedDt, pathId, ""}
 	return
 
 }
 
 func scanWithComment(row scanRow) (entry *FileEntry, err error) {
 	var id int64
-	var name, md5sum, archiveId string
-	var mtime, size int64
+	var name, md5sum, sha256 string
+	var archiveId sql.NullString
+	var mtime, size, prevId, replacedDt, pathId int64
 	var lock int
 	var comment sql.NullString
 
-	err = row.Scan(&id, &name, &md5sum, &mtime, &size, &archiveId, &lock, &comment)
+	err = row.Scan(&id, &name, &md5sum, &sha256, &mtime, &size, &archiveId, &lock, &prevId, &replacedDt, &pathId, &comment)
 	if err == sql.ErrNoRows {
 		return nil, err
 	}
@@ -68,7 +92,7 @@ func scanWithComment(row scanRow) (entry *FileEntry, err error) {
 	} else {
 		c = ""
 	}
-	entry = &FileEntry{id, name, md5sum, mtime, size, archiveId, lock, c}
+	entry = &FileEntry{id, name, md5sum, sha256, mtime, size, archiveId.String, lock, prevId, replacedDt, pathId, c}
 	return
 
 }
@@ -86,24 +110,70 @@ func FindEntrySingle(db *sql.DB, query string, args ...interface{}) (*FileEntry,
 
 }
 
+/*
+IDでエントリを探す。パスが複数あれば最初に登録したパスで返す
+*/
+func FindEntryById(db *sql.DB, id int64) (*FileEntry, error) {
+	return FindEntrySingle(db, " where e.id=? order by p.id", id)
+}
+
+/*
+パスから現在の版を探す。新しい版のアップロード中は前の版と両方が現在の版なので、新しい方を返す
+*/
 func FindEntryByName(db *sql.DB, relPath string) (*FileEntry, error) {
-	return FindEntrySingle(db, " where name=?", relPath)
+	return FindEntrySingle(db, " where p.name=? order by p.id desc", relPath)
+}
+
+/*
+同じ内容の全てのパスを登録順に返す
+*/
+func FindPaths(db *sql.DB, id int64) ([]FileEntry, error) {
+	return FindEntryByQuery(db, " where e.id=? and "+currentOnly+" order by p.id", id)
+}
+
+/*
+パスの全ての版を古い順に返す
+
+そのパスの最新のエントリから前の版をたどるので、途中でパスが変わった版も含む
+*/
+func FindVersions(db *sql.DB, relPath string) ([]FileEntry, error) {
+	e, err := FindEntrySingle(db, " where coalesce(p.name, e.name)=? order by e.id desc", relPath)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	versions := []FileEntry{*e}
+	for e.PrevId != 0 {
+		e, err = FindEntryById(db, e.PrevId)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			// 削除された版より前はたどれない
+			break
+		}
+		versions = append([]FileEntry{*e}, versions...)
+	}
+	return versions, nil
 }
 
 func FindEntryByMD5(db *sql.DB, md5sum string) (*FileEntry, error) {
-	return FindEntrySingle(db, " where md5sum=?", md5sum)
+	return FindEntrySingle(db, " where e.md5sum=? and e.replaced_dt=0 and "+currentOnly+" order by p.id", md5sum)
 }
 
 func FindEntryByArchiveId(db *sql.DB, archiveId string) (*FileEntry, error) {
-	return FindEntrySingle(db, " where archive_id=?", archiveId)
+	return FindEntrySingle(db, " where e.archive_id=? or e.id in (select entry_id from replica where archive_id=?) order by p.id", archiveId, archiveId)
 }
 
 func LockedEntry(db *sql.DB) ([]FileEntry, error) {
-	return FindEntryByQuery(db, " where lock=1")
+	return FindEntryByQuery(db, " where p.lock=1")
 }
 
+/*
+現在の版のエントリ全て(パスごと)。置き換えられた古い版は含まない
+*/
 func AllEntry(db *sql.DB) ([]FileEntry, error) {
-	return FindEntryByQuery(db, "")
+	return FindEntryByQuery(db, " where "+currentOnly+" order by e.id, p.id")
 }
 
 func FindEntryByQuery(db *sql.DB, query string, args ...interface{}) ([]FileEntry, error) {
@@ -125,7 +195,7 @@ func FindEntryByQuery(db *sql.DB, query string, args ...interface{}) ([]FileEntr
 }
 
 func LsComment(db *sql.DB) ([]FileEntry, error) {
-	return FindEntryByQueryWithComment(db, "")
+	return FindEntryByQueryWithComment(db, " where "+currentOnly+" order by e.id, p.id")
 }
 
 func FindEntryByQueryWithComment(db *sql.DB, query string, args ...interface{}) ([]FileEntry, error) {
@@ -155,12 +225,86 @@ func GetIV(db *sql.DB, id int64) ([]byte, error) {
 	return iv, nil
 }
 
-func UpdateName(db *sql.DB, id int64, newName string) error {
-	_, err := db.Exec("update file_entry set name=? where id=?", newName, id)
+/*
+内容にパスを追加する
+*/
+func InsertPath(db *sql.DB, id int64, name string, mtime int64, lock int) error {
+	_, err := db.Exec("insert into file_path (entry_id, name, mtime, lock) values (?, ?, ?, ?)", id, name, mtime, lock)
 	return errors.WithStack(err)
 }
 
+/*
+パスを書き換える(ファイルの移動)
+*/
+func UpdateName(db *sql.DB, pathId int64, newName string) error {
+	_, err := db.Exec("update file_path set name=? where id=?", newName, pathId)
+	return errors.WithStack(err)
+}
+
+/*
+内容の全てのパスをロック/アンロックする
+*/
 func UpdateLock(db *sql.DB, id int64, lock int) error {
-	_, err := db.Exec("update file_entry set lock=? where id=?", lock, id)
+	_, err := db.Exec("update file_path set lock=? where entry_id=?", lock, id)
+	return errors.WithStack(err)
+}
+
+/*
+内容が変わっていないファイルの更新日時を記録し直す
+*/
+func UpdateMtime(db *sql.DB, pathId int64, mtime int64) error {
+	_, err := db.Exec("update file_path set mtime=? where id=?", mtime, pathId)
+	return errors.WithStack(err)
+}
+
+/*
+パスをカタログから外す。内容とアーカイブはそのまま
+*/
+func DeletePath(db *sql.DB, pathId int64) error {
+	_, err := db.Exec("delete from file_path where id=?", pathId)
+	return errors.WithStack(err)
+}
+
+/*
+パスnameの古い版を新しい版に置き換えられたものとして記録する
+
+古い版のパスを外し、他のパスが残っていなければ置き換えられた日時を記録する
+*/
+func ReplaceEntry(db *sql.DB, id int64, name string, replaced time.Time) error {
+	_, err := db.Exec("delete from file_path where entry_id=? and name=?", id, name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = db.Exec("update file_entry set replaced_dt=? where id=? and not exists (select 1 from file_path where entry_id=?)",
+		replaced.UnixNano(), id, id)
+	return errors.WithStack(err)
+}
+
+func UpdateArchiveId(db *sql.DB, id int64, archiveId string) error {
+	_, err := db.Exec("update file_entry set archive_id=? where id=?", archiveId, id)
+	return errors.WithStack(err)
+}
+
+/*
+エントリとそれに付随する行(パス、IV、コメント、取得要求、コピー、アップロード状態、範囲取得要求、restoreの取得要求)を削除する
+*/
+func DeleteEntry(tx *sql.Tx, id int64) error {
+	err := DeleteUploadState(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"initial_vector", "comments", "ex_request", "lock_option"} {
+		_, err := tx.Exec("delete from "+table+" where id=?", id)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for _, table := range []string{"file_path", "replica", "range_request", "restore_request"} {
+		_, err = tx.Exec("delete from "+table+" where entry_id=?", id)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err = tx.Exec("delete from file_entry where id=?", id)
 	return errors.WithStack(err)
 }
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/*
+保存先ごとに発行中のインベントリ取得ジョブ
+*/
+type InventoryRequest struct {
+	Destination string
+	JobId       string
+	StartDt     time.Time
+}
+
+func FindInventoryRequest(db *sql.DB, dest string) (*InventoryRequest, error) {
+	var jobId string
+	var sd int64
+
+	err := db.QueryRow("select job_id, start_dt from inventory_request where destination=?", dest).Scan(&jobId, &sd)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &InventoryRequest{dest, jobId, time.Unix(0, sd)}, nil
+}
+
+func InsertInventoryRequest(db *sql.DB, dest, jobId string) error {
+	_, err := db.Exec("insert into inventory_request (destination, job_id, start_dt) values (?, ?, ?)", dest, jobId, time.Now().UnixNano())
+	return errors.WithStack(err)
+}
+
+func DeleteInventoryRequest(db *sql.DB, dest string) error {
+	_, err := db.Exec("delete from inventory_request where destination=?", dest)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/*
+ロック時に指定した取得方法
+
+Tierが空なら既定のティア、NeedByがゼロ値なら期限なし
+*/
+type LockOption struct {
+	Id     int64
+	Tier   string
+	NeedBy time.Time
+}
+
+func FindLockOption(db *sql.DB, id int64) (*LockOption, error) {
+	var tier string
+	var nb int64
+
+	err := db.QueryRow("select tier, need_by from lock_option where id=?", id).Scan(&tier, &nb)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	opt := &LockOption{Id: id, Tier: tier}
+	if nb != 0 {
+		opt.NeedBy = time.Unix(0, nb)
+	}
+	return opt, nil
+}
+
+func UpdateLockOption(db *sql.DB, opt LockOption) error {
+	var nb int64
+	if !opt.NeedBy.IsZero() {
+		nb = opt.NeedBy.UnixNano()
+	}
+	_, err := db.Exec("insert or replace into lock_option (id, tier, need_by) values (?, ?, ?)", opt.Id, opt.Tier, nb)
+	return errors.WithStack(err)
+}
+
+func DeleteLockOption(db *sql.DB, id int64) error {
+	_, err := db.Exec("delete from lock_option where id=?", id)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/*
+発行中の範囲取得ジョブ
+
+RangeFrom, RangeToは要求された平文の範囲(両端を含む)。ジョブの範囲はこれを1MB境界に広げたもの
+*/
+type RangeRequest struct {
+	Id          int64
+	EntryId     int64
+	RangeFrom   int64
+	RangeTo     int64
+	Destination string
+	JobId       string
+	StartDt     time.Time
+}
+
+func FindRangeRequest(db *sql.DB, entryId, from, to int64) (*RangeRequest, error) {
+	r := RangeRequest{EntryId: entryId, RangeFrom: from, RangeTo: to}
+	var sd int64
+
+	err := db.QueryRow("select id, destination, job_id, start_dt from range_request where entry_id=? and range_from=? and range_to=?",
+		entryId, from, to).Scan(&r.Id, &r.Destination, &r.JobId, &sd)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r.StartDt = time.Unix(0, sd)
+	return &r, nil
+}
+
+func InsertRangeRequest(db *sql.DB, entryId, from, to int64, dest, jobId string) error {
+	_, err := db.Exec("insert into range_request (entry_id, range_from, range_to, destination, job_id, start_dt) values (?, ?, ?, ?, ?, ?)",
+		entryId, from, to, dest, jobId, time.Now().UnixNano())
+	return errors.WithStack(err)
+}
+
+func DeleteRangeRequest(db *sql.DB, id int64) error {
+	_, err := db.Exec("delete from range_request where id=?", id)
+	return errors.WithStack(err)
+}
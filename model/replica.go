@@ -0,0 +1,103 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/*
+アーカイブのコピー1つ分
+*/
+type Replica struct {
+	Id          int64
+	EntryId     int64
+	Destination string
+	Backend     string
+	Region      string
+	Vault       string
+	ArchiveId   string
+
+	// 不明(replicaテーブル導入前のアップロード)の場合はゼロ値
+	UploadDt time.Time
+	TreeHash string
+}
+
+const replicaColumns = "id, entry_id, destination, backend, region, vault, archive_id, upload_dt, tree_hash"
+
+func FindReplicasByEntryId(db *sql.DB, entryId int64) ([]Replica, error) {
+	return findReplicas(db, " where entry_id=? order by id", entryId)
+}
+
+/*
+エントリの指定した保存先のコピー。無ければnil
+*/
+func FindReplica(db *sql.DB, entryId int64, dest string) (*Replica, error) {
+	replicas, err := findReplicas(db, " where entry_id=? and destination=? order by id", entryId, dest)
+	if err != nil || len(replicas) == 0 {
+		return nil, err
+	}
+	return &replicas[0], nil
+}
+
+func FindReplicasByDestination(db *sql.DB, dest string) ([]Replica, error) {
+	return findReplicas(db, " where destination=? order by id", dest)
+}
+
+func findReplicas(db *sql.DB, query string, args ...interface{}) ([]Replica, error) {
+	rows, err := db.Query("select "+replicaColumns+" from replica"+query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var replicas []Replica
+	for rows.Next() {
+		var r Replica
+		var ud int64
+		err = rows.Scan(&r.Id, &r.EntryId, &r.Destination, &r.Backend, &r.Region, &r.Vault, &r.ArchiveId, &ud, &r.TreeHash)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if ud != 0 {
+			r.UploadDt = time.Unix(0, ud)
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas, nil
+}
+
+func InsertReplica(db *sql.DB, r Replica) error {
+	_, err := db.Exec(`insert into replica (entry_id, destination, backend, region, vault, archive_id, upload_dt, tree_hash)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.EntryId, r.Destination, r.Backend, r.Region, r.Vault, r.ArchiveId, r.UploadDt.UnixNano(), r.TreeHash)
+	return errors.WithStack(err)
+}
+
+/*
+エントリIDごとのコピー数
+*/
+func ReplicaCounts(db *sql.DB) (map[int64]int, error) {
+	rows, err := db.Query("select entry_id, count(*) from replica group by entry_id")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	counts := map[int64]int{}
+	for rows.Next() {
+		var id int64
+		var n int
+		err = rows.Scan(&id, &n)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		counts[id] = n
+	}
+	return counts, nil
+}
+
+func DeleteReplica(db *sql.DB, id int64) error {
+	_, err := db.Exec("delete from replica where id=?", id)
+	return errors.WithStack(err)
+}
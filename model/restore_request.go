@@ -0,0 +1,47 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/*
+glaman restoreで発行中の取得要求
+
+EntryIdは取得する版のfile_entryのid、Outは復元先(絶対パス)。同じ版でも復元先が違えば別の要求にする
+*/
+type RestoreRequest struct {
+	Id          int64
+	EntryId     int64
+	Out         string
+	JobId       string
+	Destination string
+	StartDt     time.Time
+}
+
+func FindRestoreRequest(db *sql.DB, entryId int64, out string) (*RestoreRequest, error) {
+	r := RestoreRequest{EntryId: entryId, Out: out}
+	var sd int64
+
+	err := db.QueryRow("select id, job_id, destination, start_dt from restore_request where entry_id=? and out=?",
+		entryId, out).Scan(&r.Id, &r.JobId, &r.Destination, &sd)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r.StartDt = time.Unix(0, sd)
+	return &r, nil
+}
+
+func InsertRestoreRequest(db *sql.DB, entryId int64, out, jobId, dest string) error {
+	_, err := db.Exec("insert into restore_request (entry_id, out, job_id, destination, start_dt) values (?, ?, ?, ?, ?)",
+		entryId, out, jobId, dest, time.Now().UnixNano())
+	return errors.WithStack(err)
+}
+
+func DeleteRestoreRequest(db *sql.DB, id int64) error {
+	_, err := db.Exec("delete from restore_request where id=?", id)
+	return errors.WithStack(err)
+}
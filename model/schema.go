@@ -0,0 +1,124 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+/*
+既存のDBに後から追加したテーブル・カラムを作成する
+
+newdbで作成したDBも古いDBも同じ状態になるよう、起動時に毎回実行する
+*/
+func Migrate(db *sql.DB) error {
+	stmts := []string{
+		`create table if not exists destination (id integer primary key, name text not null unique,
+			backend text not null, region text not null default '', vault text not null default '',
+			local_dir text not null default '', local_delay text not null default '',
+			storage_class text not null default '', endpoint text not null default '', cost integer not null default 0)`,
+		`create table if not exists replica (id integer primary key, entry_id integer not null,
+			destination text not null, backend text not null, region text not null, vault text not null,
+			archive_id text not null, upload_dt integer not null)`,
+		`create index if not exists replica_entry_id on replica (entry_id)`,
+		`create table if not exists inventory_request (destination text primary key, job_id text not null, start_dt integer not null)`,
+		`create table if not exists lock_option (id integer primary key, tier text not null default '', need_by integer not null default 0)`,
+		`create table if not exists upload_state (id integer primary key, destination text not null,
+			upload_id text not null default '', part_size integer not null default 0, start_dt integer not null)`,
+		`create table if not exists upload_part (upload_id text not null, start integer not null,
+			tree_hash text not null, primary key (upload_id, start))`,
+		`create table if not exists range_request (id integer primary key, entry_id integer not null,
+			range_from integer not null, range_to integer not null, destination text not null,
+			job_id text not null, start_dt integer not null)`,
+		`create table if not exists restore_request (id integer primary key, entry_id integer not null,
+			out text not null, job_id text not null, destination text not null, start_dt integer not null)`,
+		// file_entryは保存した内容(アーカイブ)で、同じ内容のファイルが複数のパスにあればfile_pathが複数行になる
+		`create table if not exists file_path (id integer primary key, entry_id integer not null,
+			name text not null, mtime integer not null, lock integer not null default 0)`,
+		`create index if not exists file_path_entry_id on file_path (entry_id)`,
+		`create index if not exists file_path_name on file_path (name)`,
+	}
+	for _, s := range stmts {
+		_, err := db.Exec(s)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	_, err := addColumn(db, "ex_request", "destination", "text not null default 'default'")
+	if err != nil {
+		return err
+	}
+	_, err = addColumn(db, "ex_request", "tier", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	// 不明(ツリーハッシュ記録前のアップロード)の場合は空
+	_, err = addColumn(db, "replica", "tree_hash", "text not null default ''")
+	if err != nil {
+		return err
+	}
+
+	// 版の管理。prev_idは前の版のid、replaced_dtは新しい版に置き換えられた日時(現在の版は0)
+	_, err = addColumn(db, "file_entry", "prev_id", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	_, err = addColumn(db, "file_entry", "replaced_dt", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+
+	// 内容のSHA-256。file_pathと同時に追加したので、追加した時にそれまでの現在の版のパスをfile_pathに移す
+	added, err := addColumn(db, "file_entry", "sha256", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	if added {
+		_, err = db.Exec(`insert into file_path (entry_id, name, mtime, lock)
+			select id, name, mtime, lock from file_entry where replaced_dt=0`)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// replicaテーブル作成前にアップロードしたものは既定の保存先にあるものとして登録する
+	_, err = db.Exec(`insert into replica (entry_id, destination, backend, region, vault, archive_id, upload_dt)
+		select e.id, 'default', coalesce((select v from config where k='backend'), 'glacier'),
+			coalesce((select v from config where k='region'), ''), coalesce((select v from config where k='vault'), ''),
+			e.archive_id, 0
+		from file_entry e
+		where e.archive_id is not null and e.archive_id != ''
+			and not exists (select 1 from replica r where r.entry_id = e.id and r.destination = 'default')`)
+	return errors.WithStack(err)
+}
+
+/*
+カラムが無ければ追加する。追加した場合trueを返す
+*/
+func addColumn(db *sql.DB, table, column, def string) (bool, error) {
+	rows, err := db.Query("pragma table_info(" + table + ")")
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec("alter table " + table + " add column " + column + " " + def)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
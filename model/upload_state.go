@@ -0,0 +1,133 @@
+package model
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/*
+途中まで進んだアップロードの状態
+
+Idはfile_entryのid。UploadIdが空ならまだアップロードを開始していない
+*/
+type UploadState struct {
+	Id          int64
+	Destination string
+	UploadId    string
+	PartSize    int64
+	StartDt     time.Time
+
+	// 完了したパート(開始位置 -> ツリーハッシュ)
+	Parts map[int64]string
+}
+
+const uploadStateColumns = "select id, destination, upload_id, part_size, start_dt from upload_state"
+
+func scanUploadState(row scanRow) (*UploadState, error) {
+	var st UploadState
+	var startDt int64
+	err := row.Scan(&st.Id, &st.Destination, &st.UploadId, &st.PartSize, &startDt)
+	if err != nil {
+		return nil, err
+	}
+	st.StartDt = time.Unix(0, startDt)
+	return &st, nil
+}
+
+func FindUploadState(db *sql.DB, id int64) (*UploadState, error) {
+	st, err := scanUploadState(db.QueryRow(uploadStateColumns+" where id=?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	st.Parts, err = findUploadParts(db, st.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func AllUploadStates(db *sql.DB) ([]UploadState, error) {
+	rows, err := db.Query(uploadStateColumns + " order by id")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var states []UploadState
+	for rows.Next() {
+		st, err := scanUploadState(rows)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		states = append(states, *st)
+	}
+	return states, errors.WithStack(rows.Err())
+}
+
+func findUploadParts(db *sql.DB, uploadId string) (map[int64]string, error) {
+	parts := map[int64]string{}
+	if uploadId == "" {
+		return parts, nil
+	}
+
+	rows, err := db.Query("select start, tree_hash from upload_part where upload_id=?", uploadId)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var start int64
+		var hash string
+		err = rows.Scan(&start, &hash)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		parts[start] = hash
+	}
+	return parts, errors.WithStack(rows.Err())
+}
+
+/*
+アップロード状態を記録する。パートの記録はInsertUploadPartで行う
+*/
+func SaveUploadState(db *sql.DB, st UploadState) error {
+	_, err := db.Exec(`insert or replace into upload_state (id, destination, upload_id, part_size, start_dt)
+		values (?, ?, ?, ?, ?)`,
+		st.Id, st.Destination, st.UploadId, st.PartSize, st.StartDt.UnixNano())
+	return errors.WithStack(err)
+}
+
+/*
+アップロードを開始した(やり直した)ことを記録する
+*/
+func UpdateUploadId(db *sql.DB, id int64, uploadId string, partSize int64) error {
+	_, err := db.Exec("delete from upload_part where upload_id=(select upload_id from upload_state where id=?)", id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = db.Exec("update upload_state set upload_id=?, part_size=? where id=?", uploadId, partSize, id)
+	return errors.WithStack(err)
+}
+
+func InsertUploadPart(db *sql.DB, uploadId string, start int64, treeHash string) error {
+	_, err := db.Exec("insert or replace into upload_part (upload_id, start, tree_hash) values (?, ?, ?)", uploadId, start, treeHash)
+	return errors.WithStack(err)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func DeleteUploadState(db execer, id int64) error {
+	_, err := db.Exec("delete from upload_part where upload_id=(select upload_id from upload_state where id=?)", id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = db.Exec("delete from upload_state where id=?", id)
+	return errors.WithStack(err)
+}
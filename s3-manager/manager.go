@@ -0,0 +1,377 @@
+package s3_manager
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	STORAGE_CLASS_DEEP_ARCHIVE = s3.StorageClassDeepArchive
+	STORAGE_CLASS_GLACIER_IR   = s3.StorageClassGlacierIr
+
+	keyPrefix = "glaman/"
+
+	actionRetrieval = "ArchiveRetrieval"
+	actionInventory = "InventoryRetrieval"
+
+	statusInProgress = "InProgress"
+	statusSucceeded  = "Succeeded"
+
+	// RestoreObjectで復元したコピーの保持日数
+	DEFAULT_RESTORE_DAYS = 7
+
+	// マルチパートアップロードのパートサイズの上限
+	MAX_PART_SIZE = 5 * 1024 * 1024 * 1024
+)
+
+var (
+	_ backend.Backend       = (*Manager)(nil)
+	_ backend.TierEstimator = (*Manager)(nil)
+)
+
+/*
+S3のストレージクラス(DEEP_ARCHIVE/GLACIER_IR)を保存先とするバックエンド
+
+アーカイブIDはオブジェクトキー、取得ジョブのIDもオブジェクトキーとする。
+RestoreObjectがジョブ発行、HeadObjectのx-amz-restoreがジョブの状態に対応する。
+ティアはオブジェクトに残らないので、ジョブのTierは空にする(取得要求の記録を使う)
+*/
+type Manager struct {
+	Bucket, Region, StorageClass string
+	RestoreDays                  int64
+
+	AwsSession *session.Session
+}
+
+/*
+endpointを指定するとS3互換のサーバ(ローカルのスタブ等)にパス形式で接続する
+*/
+func New(bucket, region, storageClass, endpoint string) (*Manager, error) {
+	switch storageClass {
+	case STORAGE_CLASS_DEEP_ARCHIVE, STORAGE_CLASS_GLACIER_IR:
+	default:
+		return nil, errors.Errorf("未対応のストレージクラスです: %s", storageClass)
+	}
+
+	cfg := &aws.Config{
+		Region: aws.String(region),
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Manager{bucket, region, storageClass, DEFAULT_RESTORE_DAYS, sess}, nil
+}
+
+func (m *Manager) Upload(logger *log.Logger, src backend.Source) (string, string, error) {
+	key, err := newKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	partSize, err := partSizeFor(src.Size())
+	if err != nil {
+		return "", "", err
+	}
+
+	// 先頭から順に読まれるので、読みながらツリーハッシュを計算する
+	th := backend.NewTreeHasher()
+	uploader := s3manager.NewUploader(m.AwsSession, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket:       aws.String(m.Bucket),
+		Key:          aws.String(key),
+		Body:         io.TeeReader(io.NewSectionReader(src, 0, src.Size()), th),
+		StorageClass: aws.String(m.StorageClass),
+	})
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	logger.Printf("Upload success. archiveId=%v\n", key)
+	return key, th.String(), nil
+}
+
+func (m *Manager) RequestRetrieve(archiveId, tier string) (string, error) {
+	svc := s3.New(m.AwsSession)
+
+	head, err := m.head(archiveId)
+	if err != nil {
+		return "", err
+	}
+	if !isArchiveClass(aws.StringValue(head.StorageClass)) {
+		// GLACIER_IR等はそのまま取得できるのでジョブ発行は不要
+		return archiveId, nil
+	}
+
+	_, err = svc.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: aws.String(m.Bucket),
+		Key:    aws.String(archiveId),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(m.RestoreDays),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(tier),
+			},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "RestoreAlreadyInProgress" {
+			return "", errors.WithStack(err)
+		}
+	}
+	return archiveId, nil
+}
+
+/*
+DEEP_ARCHIVEはExpeditedに対応していない。GLACIER_IRは即時に取得できる
+*/
+func (m *Manager) TierDurations() map[string]time.Duration {
+	if m.StorageClass == STORAGE_CLASS_GLACIER_IR {
+		return map[string]time.Duration{
+			backend.TIER_BULK: 0,
+		}
+	}
+	return map[string]time.Duration{
+		backend.TIER_STANDARD: 12 * time.Hour,
+		backend.TIER_BULK:     48 * time.Hour,
+	}
+}
+
+/*
+復元したコピーの保持期限が過ぎてx-amz-restoreが無くなっていればErrJobExpiredを返す
+*/
+func (m *Manager) DescribeJob(jobId string) (*backend.Job, error) {
+	head, err := m.head(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &backend.Job{
+		JobId:       jobId,
+		Action:      actionRetrieval,
+		ArchiveId:   jobId,
+		StatusCode:  statusInProgress,
+		ArchiveSize: aws.Int64Value(head.ContentLength),
+	}
+	if head.LastModified != nil {
+		job.CreationDate = *head.LastModified
+	}
+
+	if !isArchiveClass(aws.StringValue(head.StorageClass)) {
+		job.Completed = true
+		job.StatusCode = statusSucceeded
+		return job, nil
+	}
+
+	ongoing, expiry, ok := parseRestore(aws.StringValue(head.Restore))
+	if !ok || (!ongoing && !expiry.IsZero() && expiry.Before(time.Now())) {
+		return nil, backend.ErrJobExpired
+	}
+	if !ongoing {
+		job.Completed = true
+		job.StatusCode = statusSucceeded
+	}
+	return job, nil
+}
+
+func (m *Manager) JobList() ([]*backend.Job, error) {
+	svc := s3.New(m.AwsSession)
+
+	var jobs []*backend.Job
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:                   aws.String(m.Bucket),
+		Prefix:                   aws.String(keyPrefix),
+		OptionalObjectAttributes: []*string{aws.String(s3.OptionalObjectAttributesRestoreStatus)},
+	}, func(out *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range out.Contents {
+			if o.RestoreStatus == nil {
+				continue
+			}
+			job := &backend.Job{
+				JobId:       aws.StringValue(o.Key),
+				Action:      actionRetrieval,
+				ArchiveId:   aws.StringValue(o.Key),
+				StatusCode:  statusSucceeded,
+				Completed:   true,
+				ArchiveSize: aws.Int64Value(o.Size),
+			}
+			if aws.BoolValue(o.RestoreStatus.IsRestoreInProgress) {
+				job.StatusCode = statusInProgress
+				job.Completed = false
+			}
+			if o.LastModified != nil {
+				job.CreationDate = *o.LastModified
+			}
+			jobs = append(jobs, job)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return jobs, nil
+}
+
+func (m *Manager) DownloadFile(logger *log.Logger, jobId, filePath string) error {
+	logger.Printf("check job %s", filePath)
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		return err
+	}
+	if !job.Completed {
+		return backend.ErrJobNotComplete
+	}
+	logger.Printf("Retrieve job %s", filePath)
+
+	path, _ := filepath.Split(filePath)
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	downloader := s3manager.NewDownloader(m.AwsSession)
+	_, err = downloader.Download(f, &s3.GetObjectInput{
+		Bucket: aws.String(m.Bucket),
+		Key:    aws.String(job.ArchiveId),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logger.Printf("Download done.\n")
+	return nil
+}
+
+func (m *Manager) DeleteArchive(archiveId string) error {
+	svc := s3.New(m.AwsSession)
+
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(m.Bucket),
+		Key:    aws.String(archiveId),
+	})
+	return errors.WithStack(err)
+}
+
+/*
+S3は一覧が即時に取れるのでジョブは発行しない。ジョブIDは便宜上のもの
+*/
+func (m *Manager) RequestInventory() (string, error) {
+	return actionInventory, nil
+}
+
+func (m *Manager) Inventory(jobId string) (*backend.Inventory, error) {
+	svc := s3.New(m.AwsSession)
+
+	inv := &backend.Inventory{InventoryDate: time.Now()}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(m.Bucket),
+		Prefix: aws.String(keyPrefix),
+	}, func(out *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range out.Contents {
+			a := backend.Archive{
+				ArchiveId: aws.StringValue(o.Key),
+				Size:      aws.Int64Value(o.Size),
+			}
+			if o.LastModified != nil {
+				a.CreationDate = *o.LastModified
+			}
+			inv.Archives = append(inv.Archives, a)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return inv, nil
+}
+
+func (m *Manager) head(key string) (*s3.HeadObjectOutput, error) {
+	svc := s3.New(m.AwsSession)
+
+	out, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(m.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return out, nil
+}
+
+// 取得にRestoreObjectが必要なストレージクラスか
+func isArchiveClass(storageClass string) bool {
+	return storageClass == s3.StorageClassDeepArchive || storageClass == s3.StorageClassGlacier
+}
+
+var restoreAttr = regexp.MustCompile(`([a-z-]+)="([^"]*)"`)
+
+/*
+x-amz-restoreヘッダを解釈する。復元中ならongoingがtrue、完了していればexpiryに保持期限を返す
+
+ヘッダが無い(復元を要求していないか、保持期限が過ぎた)か解釈できなければokがfalse。
+例: ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+*/
+func parseRestore(restore string) (ongoing bool, expiry time.Time, ok bool) {
+	attrs := map[string]string{}
+	for _, m := range restoreAttr.FindAllStringSubmatch(restore, -1) {
+		attrs[m[1]] = m[2]
+	}
+	switch attrs["ongoing-request"] {
+	case "true":
+		return true, time.Time{}, true
+	case "false":
+	default:
+		return false, time.Time{}, false
+	}
+	if v, found := attrs["expiry-date"]; found {
+		t, err := time.Parse(time.RFC1123, v)
+		if err == nil {
+			expiry = t
+		}
+	}
+	return false, expiry, true
+}
+
+/*
+パート数が上限(10,000)に収まる最小のパートサイズ。既定の5MBのままでは約48.8GBまでしかアップロードできない
+*/
+func partSizeFor(size int64) (int64, error) {
+	for ps := int64(s3manager.MinUploadPartSize); ps <= MAX_PART_SIZE; ps *= 2 {
+		if (size+ps-1)/ps <= s3manager.MaxUploadParts {
+			return ps, nil
+		}
+	}
+	return 0, errors.Errorf("ファイルが大きすぎます(%d bytes)", size)
+}
+
+func newKey() (string, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("%s%x", keyPrefix, b), nil
+}
@@ -0,0 +1,502 @@
+package s3_manager
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/rami1942/glaman/backend"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucket = "test"
+
+var discard = log.New(ioutil.Discard, "", 0)
+
+func TestParseRestore(t *testing.T) {
+	expiry := time.Date(2012, 12, 21, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		restore string
+		ongoing bool
+		expiry  time.Time
+		ok      bool
+	}{
+		{`ongoing-request="true"`, true, time.Time{}, true},
+		{`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`, false, expiry, true},
+		// 順序が違っても良い
+		{`expiry-date="Fri, 21 Dec 2012 00:00:00 GMT", ongoing-request="false"`, false, expiry, true},
+		{`ongoing-request="false"`, false, time.Time{}, true},
+		{`ongoing-request="false", expiry-date="tomorrow"`, false, time.Time{}, true},
+		{``, false, time.Time{}, false},
+		{`ongoing-request="maybe"`, false, time.Time{}, false},
+		{`expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`, false, time.Time{}, false},
+	} {
+		ongoing, exp, ok := parseRestore(tt.restore)
+		if ongoing != tt.ongoing || !exp.Equal(tt.expiry) || ok != tt.ok {
+			t.Errorf("parseRestore(%q) = %v, %v, %v, want %v, %v, %v",
+				tt.restore, ongoing, exp, ok, tt.ongoing, tt.expiry, tt.ok)
+		}
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	const mb = 1024 * 1024
+	for _, tt := range []struct {
+		size, partSize int64
+	}{
+		{0, 5 * mb},
+		{1, 5 * mb},
+		{10000 * 5 * mb, 5 * mb},
+		{10000*5*mb + 1, 10 * mb},
+		{100 * 1024 * mb, 20 * mb},
+		{10000 * MAX_PART_SIZE, MAX_PART_SIZE},
+	} {
+		ps, err := partSizeFor(tt.size)
+		if err != nil || ps != tt.partSize {
+			t.Errorf("partSizeFor(%d) = %d, %v, want %d", tt.size, ps, err, tt.partSize)
+		}
+	}
+
+	_, err := partSizeFor(10000*MAX_PART_SIZE + 1)
+	if err == nil {
+		t.Error("too large size is accepted")
+	}
+}
+
+/*
+テストで使うS3のサブセット(パス形式のPut/Head/Get/Delete/RestoreObjectとListObjectsV2)
+*/
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	// RestoreObjectで指定されたティア(キー -> ティア)
+	tiers map[string]string
+	// 保持期限が過ぎてもしばらくx-amz-restoreを返し続ける
+	staleRestore bool
+}
+
+type fakeObject struct {
+	data         []byte
+	storageClass string
+	lastModified time.Time
+
+	// RestoreObject済みか、復元中か、復元したコピーの保持期限
+	restoreRequested bool
+	ongoing          bool
+	expiry           time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]*fakeObject{}, tiers: map[string]string{}}
+}
+
+/*
+復元の状態を変える。ongoingがfalseならexpiryまで取得できる
+*/
+func (s *fakeS3) setRestore(key string, ongoing bool, expiry time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.objects[key]
+	o.restoreRequested = true
+	o.ongoing = ongoing
+	o.expiry = expiry
+}
+
+func (s *fakeS3) setStaleRestore(stale bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.staleRestore = stale
+}
+
+func (s *fakeS3) tier(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tier, ok := s.tiers[key]
+	return tier, ok
+}
+
+func (s *fakeS3) restoreHeader(o *fakeObject) string {
+	switch {
+	case !o.restoreRequested:
+		return ""
+	case o.ongoing:
+		return `ongoing-request="true"`
+	case o.expiry.Before(time.Now()) && !s.staleRestore:
+		// 期限が過ぎるとヘッダが無くなる
+		return ""
+	}
+	return fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`, o.expiry.UTC().Format(http.TimeFormat))
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if p[0] != testBucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(p) == 1 || p[1] == "" {
+		if r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+			s.list(w, r)
+			return
+		}
+		s.error(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	key := p[1]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method == "PUT" {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		class := r.Header.Get("X-Amz-Storage-Class")
+		if class == "" {
+			class = "STANDARD"
+		}
+		s.objects[key] = &fakeObject{data: data, storageClass: class, lastModified: time.Now().UTC()}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	o, ok := s.objects[key]
+	if !ok {
+		s.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	archived := o.storageClass == "DEEP_ARCHIVE" || o.storageClass == "GLACIER"
+
+	switch {
+	case r.Method == "POST" && r.URL.Query()["restore"] != nil:
+		if !archived {
+			s.error(w, http.StatusForbidden, "InvalidObjectState")
+			return
+		}
+		var req struct {
+			Days int64
+			Tier string `xml:"GlacierJobParameters>Tier"`
+		}
+		err := xml.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		if o.restoreRequested && o.ongoing {
+			s.error(w, http.StatusConflict, "RestoreAlreadyInProgress")
+			return
+		}
+		s.tiers[key] = req.Tier
+		o.restoreRequested = true
+		o.ongoing = true
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "HEAD":
+		s.writeHeaders(w, o)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(o.data)))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET":
+		if archived && s.restoreHeader(o) == "" || o.ongoing {
+			s.error(w, http.StatusForbidden, "InvalidObjectState")
+			return
+		}
+		s.writeHeaders(w, o)
+		from, to := int64(0), int64(len(o.data))-1
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			fmt.Sscanf(rng, "bytes=%d-%d", &from, &to)
+			if to >= int64(len(o.data)) {
+				to = int64(len(o.data)) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, len(o.data)))
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", to-from+1))
+		w.WriteHeader(status)
+		w.Write(o.data[from : to+1])
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// 呼び出し側でロックすること
+func (s *fakeS3) writeHeaders(w http.ResponseWriter, o *fakeObject) {
+	w.Header().Set("Last-Modified", o.lastModified.Format(http.TimeFormat))
+	if o.storageClass != "STANDARD" {
+		w.Header().Set("X-Amz-Storage-Class", o.storageClass)
+	}
+	if h := s.restoreHeader(o); h != "" {
+		w.Header().Set("X-Amz-Restore", h)
+	}
+}
+
+type listContents struct {
+	Key           string
+	Size          int64
+	LastModified  string
+	StorageClass  string
+	RestoreStatus *restoreStatus `xml:",omitempty"`
+}
+
+type restoreStatus struct {
+	IsRestoreInProgress bool
+	RestoreExpiryDate   string `xml:",omitempty"`
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	withRestore := strings.Contains(r.Header.Get("X-Amz-Optional-Object-Attributes"), "RestoreStatus")
+
+	s.mu.Lock()
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var contents []listContents
+	for _, k := range keys {
+		o := s.objects[k]
+		c := listContents{Key: k, Size: int64(len(o.data)), LastModified: o.lastModified.Format(time.RFC3339),
+			StorageClass: o.storageClass}
+		if withRestore && s.restoreHeader(o) != "" {
+			c.RestoreStatus = &restoreStatus{IsRestoreInProgress: o.ongoing}
+			if !o.ongoing {
+				c.RestoreStatus.RestoreExpiryDate = o.expiry.UTC().Format(time.RFC3339)
+			}
+		}
+		contents = append(contents, c)
+	}
+	s.mu.Unlock()
+
+	out := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []listContents
+	}{Name: testBucket, Prefix: prefix, KeyCount: len(contents), Contents: contents}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&out)
+}
+
+func (s *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func newTestManager(t *testing.T, storageClass string) (*Manager, *fakeS3, func()) {
+	s := newFakeS3()
+	srv := httptest.NewServer(s)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "x")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "y")
+	m, err := New(testBucket, "us-east-1", storageClass, srv.URL)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	m.AwsSession.Config.MaxRetries = aws.Int(0)
+	return m, s, srv.Close
+}
+
+func testData() []byte {
+	data := make([]byte, 100*1024+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func upload(t *testing.T, m *Manager, data []byte) string {
+	key, treeHash, err := m.Upload(discard, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.HasPrefix(key, keyPrefix) {
+		t.Errorf("key = %s", key)
+	}
+	h, err := backend.TreeHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if treeHash != fmt.Sprintf("%x", h) {
+		t.Errorf("tree hash = %s, want %x", treeHash, h)
+	}
+	return key
+}
+
+func download(t *testing.T, m *Manager, jobId string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "glaman-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	err = m.DownloadFile(discard, jobId, out)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, nil
+}
+
+func TestDeepArchiveRestore(t *testing.T) {
+	m, s, cleanup := newTestManager(t, STORAGE_CLASS_DEEP_ARCHIVE)
+	defer cleanup()
+
+	data := testData()
+	key := upload(t, m, data)
+
+	// 取得要求を出す前はジョブが無い
+	_, err := m.DescribeJob(key)
+	if err != backend.ErrJobExpired {
+		t.Errorf("before restore: err = %v, want ErrJobExpired", err)
+	}
+
+	jobId, err := m.RequestRetrieve(key, backend.TIER_BULK)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if tier, _ := s.tier(key); tier != backend.TIER_BULK {
+		t.Errorf("restore tier = %q", tier)
+	}
+	// 復元中にもう一度要求してもエラーにしない
+	_, err = m.RequestRetrieve(key, backend.TIER_BULK)
+	if err != nil {
+		t.Errorf("request again: %+v", err)
+	}
+
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if job.Completed || job.StatusCode != statusInProgress || job.ArchiveSize != int64(len(data)) || job.Tier != "" {
+		t.Errorf("in progress: job = %+v", job)
+	}
+	_, err = download(t, m, jobId)
+	if err != backend.ErrJobNotComplete {
+		t.Errorf("in progress: err = %v, want ErrJobNotComplete", err)
+	}
+	jobs, err := m.JobList()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(jobs) != 1 || jobs[0].JobId != key || jobs[0].Completed {
+		t.Errorf("in progress: jobs = %+v", jobs)
+	}
+
+	s.setRestore(key, false, time.Now().Add(24*time.Hour))
+	job, err = m.DescribeJob(jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !job.Completed || job.StatusCode != statusSucceeded {
+		t.Errorf("restored: job = %+v", job)
+	}
+	got, err := download(t, m, jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes differ from uploaded %d bytes", len(got), len(data))
+	}
+	jobs, err = m.JobList()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(jobs) != 1 || !jobs[0].Completed {
+		t.Errorf("restored: jobs = %+v", jobs)
+	}
+
+	// 保持期限が過ぎた
+	s.setRestore(key, false, time.Now().Add(-time.Hour))
+	_, err = m.DescribeJob(jobId)
+	if err != backend.ErrJobExpired {
+		t.Errorf("expired: err = %v, want ErrJobExpired", err)
+	}
+	_, err = download(t, m, jobId)
+	if err != backend.ErrJobExpired {
+		t.Errorf("expired: download err = %v, want ErrJobExpired", err)
+	}
+	jobs, err = m.JobList()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("expired: jobs = %+v", jobs)
+	}
+	// 過ぎた保持期限が返ってきても期限切れとする
+	s.setStaleRestore(true)
+	_, err = m.DescribeJob(jobId)
+	if err != backend.ErrJobExpired {
+		t.Errorf("stale expiry: err = %v, want ErrJobExpired", err)
+	}
+	s.setStaleRestore(false)
+
+	inv, err := m.Inventory(actionInventory)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(inv.Archives) != 1 || inv.Archives[0].ArchiveId != key || inv.Archives[0].Size != int64(len(data)) {
+		t.Errorf("inventory = %+v", inv.Archives)
+	}
+
+	err = m.DeleteArchive(key)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	_, err = m.DescribeJob(key)
+	if err == nil {
+		t.Error("deleted object is found")
+	}
+}
+
+func TestGlacierIRRetrieve(t *testing.T) {
+	m, s, cleanup := newTestManager(t, STORAGE_CLASS_GLACIER_IR)
+	defer cleanup()
+
+	data := testData()
+	key := upload(t, m, data)
+
+	jobId, err := m.RequestRetrieve(key, backend.TIER_BULK)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := s.tier(key); ok {
+		t.Error("restore is requested for GLACIER_IR")
+	}
+	job, err := m.DescribeJob(jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !job.Completed {
+		t.Errorf("job = %+v", job)
+	}
+	got, err := download(t, m, jobId)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes differ from uploaded %d bytes", len(got), len(data))
+	}
+}
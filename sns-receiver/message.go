@@ -0,0 +1,224 @@
+package sns_receiver
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	TYPE_NOTIFICATION              = "Notification"
+	TYPE_SUBSCRIPTION_CONFIRMATION = "SubscriptionConfirmation"
+	TYPE_UNSUBSCRIBE_CONFIRMATION  = "UnsubscribeConfirmation"
+)
+
+var (
+	ErrInvalidSignature = errors.New("SNS message signature is invalid.")
+
+	// SNSの証明書やサブスクリプション確認のURLはこのホストのもののみ受け付ける
+	snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+)
+
+/*
+SNSがHTTPエンドポイントにPOSTするメッセージ
+*/
+type Message struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	SubscribeURL     string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+}
+
+/*
+署名対象の文字列
+
+メッセージの種類ごとに決まった順でキーと値を改行区切りで並べる。Subjectは無ければ含めない
+*/
+func (m *Message) stringToSign() (string, error) {
+	var keys []string
+	switch m.Type {
+	case TYPE_NOTIFICATION:
+		keys = []string{"Message", "MessageId", "Subject", "Timestamp", "TopicArn", "Type"}
+	case TYPE_SUBSCRIPTION_CONFIRMATION, TYPE_UNSUBSCRIBE_CONFIRMATION:
+		keys = []string{"Message", "MessageId", "SubscribeURL", "Timestamp", "Token", "TopicArn", "Type"}
+	default:
+		return "", errors.Errorf("不明なメッセージの種類です: %s", m.Type)
+	}
+
+	values := map[string]string{
+		"Message":      m.Message,
+		"MessageId":    m.MessageId,
+		"Subject":      m.Subject,
+		"SubscribeURL": m.SubscribeURL,
+		"Timestamp":    m.Timestamp,
+		"Token":        m.Token,
+		"TopicArn":     m.TopicArn,
+		"Type":         m.Type,
+	}
+	s := ""
+	for _, k := range keys {
+		if k == "Subject" && m.Subject == "" {
+			continue
+		}
+		s += k + "\n" + values[k] + "\n"
+	}
+	return s, nil
+}
+
+/*
+SNSメッセージの署名の確認
+
+Certを設定した場合はSigningCertURLから取得せずにその証明書で確認する(記録したメッセージでの動作確認用)
+*/
+type Verifier struct {
+	Cert   *x509.Certificate
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*x509.Certificate
+}
+
+/*
+PEM形式の証明書ファイルを読む
+*/
+func LoadCert(fileName string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("%s: PEM形式の証明書ではありません", fileName)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	return cert, errors.WithStack(err)
+}
+
+func (v *Verifier) Verify(m *Message) error {
+	var hash crypto.Hash
+	switch m.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return errors.Wrapf(ErrInvalidSignature, "未対応の署名バージョンです: %s", m.SignatureVersion)
+	}
+
+	s, err := m.stringToSign()
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return errors.Wrap(ErrInvalidSignature, err.Error())
+	}
+
+	cert, err := v.cert(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.Wrap(ErrInvalidSignature, "証明書の公開鍵がRSAではありません")
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		h := sha1.Sum([]byte(s))
+		digest = h[:]
+	} else {
+		h := sha256.Sum256([]byte(s))
+		digest = h[:]
+	}
+	err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	if err != nil {
+		return errors.Wrap(ErrInvalidSignature, err.Error())
+	}
+	return nil
+}
+
+/*
+署名の確認に使う証明書。取得したものはURLごとに覚えておく
+*/
+func (v *Verifier) cert(certURL string) (*x509.Certificate, error) {
+	if v.Cert != nil {
+		return v.Cert, nil
+	}
+	err := checkSNSURL(certURL)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.cache[certURL]; ok {
+		return c, nil
+	}
+
+	data, err := get(v.Client, certURL)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("%s: PEM形式の証明書ではありません", certURL)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if v.cache == nil {
+		v.cache = map[string]*x509.Certificate{}
+	}
+	v.cache[certURL] = cert
+	return cert, nil
+}
+
+/*
+SNSのURL(https://sns.<region>.amazonaws.com/...)であることを確認する
+*/
+func checkSNSURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if u.Scheme != "https" || !snsHost.MatchString(u.Host) {
+		return errors.Errorf("SNSのURLではありません: %s", s)
+	}
+	return nil
+}
+
+func get(client *http.Client, s string) ([]byte, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Get(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: %s", s, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, errors.WithStack(err)
+}
@@ -0,0 +1,247 @@
+package sns_receiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/*
+testdataのメッセージはtestdata/cert.pemの鍵で署名してある。SigningCertURLへのアクセスはfakeSNSが答える
+*/
+const testTopic = "arn:aws:sns:us-east-1:123456789012:glaman"
+
+/*
+SNSの代わりに証明書とサブスクリプション確認のURLに答えるhttp.RoundTripper
+*/
+type fakeSNS struct {
+	cert []byte
+
+	mu   sync.Mutex
+	urls []string
+}
+
+func (f *fakeSNS) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.urls = append(f.urls, req.URL.String())
+	f.mu.Unlock()
+
+	body := []byte("<ConfirmSubscriptionResponse/>")
+	if strings.HasSuffix(req.URL.Path, ".pem") {
+		body = f.cert
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func (f *fakeSNS) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.urls...)
+}
+
+func loadMessage(t *testing.T, name string) Message {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Message
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestVerify(t *testing.T) {
+	cert, err := ioutil.ReadFile(filepath.Join("testdata", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		file   string
+		modify func(m *Message)
+		// 署名の不正ならErrInvalidSignature、URLの不正などはそれ以外のエラー
+		invalidSignature bool
+		otherError       bool
+	}{
+		{name: "notification", file: "notification.json"},
+		{name: "subscription confirmation", file: "subscription_confirmation.json"},
+		{name: "tampered message", file: "notification.json", modify: func(m *Message) {
+			m.Message = strings.Replace(m.Message, "job1", "job2", 1)
+		}, invalidSignature: true},
+		{name: "tampered topic", file: "notification.json", modify: func(m *Message) {
+			m.TopicArn = "arn:aws:sns:us-east-1:999999999999:other"
+		}, invalidSignature: true},
+		{name: "tampered subscribe url", file: "subscription_confirmation.json", modify: func(m *Message) {
+			m.SubscribeURL = "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=other"
+		}, invalidSignature: true},
+		{name: "subject removed", file: "notification.json", modify: func(m *Message) {
+			m.Subject = ""
+		}, invalidSignature: true},
+		{name: "broken signature", file: "notification.json", modify: func(m *Message) {
+			m.Signature = "!" + m.Signature
+		}, invalidSignature: true},
+		{name: "unsupported signature version", file: "notification.json", modify: func(m *Message) {
+			m.SignatureVersion = "3"
+		}, invalidSignature: true},
+		{name: "non-amazonaws cert url", file: "notification.json", modify: func(m *Message) {
+			m.SigningCertURL = "https://sns.us-east-1.amazonaws.com.example.com/cert.pem"
+		}, otherError: true},
+		{name: "plain http cert url", file: "notification.json", modify: func(m *Message) {
+			m.SigningCertURL = strings.Replace(m.SigningCertURL, "https:", "http:", 1)
+		}, otherError: true},
+		{name: "unknown type", file: "notification.json", modify: func(m *Message) {
+			m.Type = "Other"
+		}, otherError: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := loadMessage(t, tt.file)
+			if tt.modify != nil {
+				tt.modify(&m)
+			}
+			sns := &fakeSNS{cert: cert}
+			v := Verifier{Client: &http.Client{Transport: sns}}
+
+			err := v.Verify(&m)
+			switch {
+			case tt.invalidSignature:
+				if errors.Cause(err) != ErrInvalidSignature {
+					t.Errorf("err = %v, want ErrInvalidSignature", err)
+				}
+			case tt.otherError:
+				if err == nil || errors.Cause(err) == ErrInvalidSignature {
+					t.Errorf("err = %v, want an error other than ErrInvalidSignature", err)
+				}
+				if urls := sns.requested(); len(urls) != 0 {
+					t.Errorf("fetched %v", urls)
+				}
+			default:
+				if err != nil {
+					t.Errorf("%+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifierCachesCert(t *testing.T) {
+	cert, err := ioutil.ReadFile(filepath.Join("testdata", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sns := &fakeSNS{cert: cert}
+	v := Verifier{Client: &http.Client{Transport: sns}}
+
+	for _, file := range []string{"notification.json", "subscription_confirmation.json"} {
+		m := loadMessage(t, file)
+		err := v.Verify(&m)
+		if err != nil {
+			t.Fatalf("%s: %+v", file, err)
+		}
+	}
+	if urls := sns.requested(); len(urls) != 1 {
+		t.Errorf("fetched %v, want the cert once", urls)
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	cert, err := LoadCert(filepath.Join("testdata", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		file   string
+		topic  string
+		modify func(m *Message)
+		status int
+		// OnNotificationに渡るか
+		notified bool
+		// SubscribeURLにアクセスするか
+		confirmed bool
+	}{
+		{name: "notification", file: "notification.json", topic: testTopic, status: http.StatusOK, notified: true},
+		{name: "any topic", file: "notification.json", status: http.StatusOK, notified: true},
+		{name: "subscription confirmation", file: "subscription_confirmation.json", topic: testTopic,
+			status: http.StatusOK, confirmed: true},
+		{name: "wrong topic", file: "notification.json", topic: "arn:aws:sns:us-east-1:123456789012:other",
+			status: http.StatusForbidden},
+		{name: "wrong topic subscription", file: "subscription_confirmation.json",
+			topic: "arn:aws:sns:us-east-1:123456789012:other", status: http.StatusForbidden},
+		{name: "tampered message", file: "notification.json", topic: testTopic, modify: func(m *Message) {
+			m.Message = strings.Replace(m.Message, "job1", "job2", 1)
+		}, status: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := loadMessage(t, tt.file)
+			if tt.modify != nil {
+				tt.modify(&m)
+			}
+			body, err := json.Marshal(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sns := &fakeSNS{}
+			notified := false
+			r := &Receiver{
+				Verifier: Verifier{Cert: cert, Client: &http.Client{Transport: sns}},
+				TopicArn: tt.topic,
+				Logger:   log.New(ioutil.Discard, "", 0),
+				OnNotification: func(got *Message) {
+					notified = got.MessageId == m.MessageId
+				},
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if notified != tt.notified {
+				t.Errorf("notified = %v, want %v", notified, tt.notified)
+			}
+			urls := sns.requested()
+			if tt.confirmed && (len(urls) != 1 || urls[0] != m.SubscribeURL) {
+				t.Errorf("fetched %v, want %s", urls, m.SubscribeURL)
+			} else if !tt.confirmed && len(urls) != 0 {
+				t.Errorf("fetched %v", urls)
+			}
+		})
+	}
+}
+
+func TestReceiverRejectsNonPost(t *testing.T) {
+	r := &Receiver{Logger: log.New(ioutil.Discard, "", 0)}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d", w.Code)
+	}
+}
+
+func TestReceiverRejectsLargeBody(t *testing.T) {
+	r := &Receiver{Logger: log.New(ioutil.Discard, "", 0)}
+	body := `{"Type":"` + strings.Repeat("x", maxBodySize) + `"}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d", w.Code)
+	}
+}
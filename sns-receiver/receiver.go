@@ -0,0 +1,84 @@
+package sns_receiver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// メッセージの最大サイズ(SNSのメッセージは256KBまで)
+const maxBodySize = 1024 * 1024
+
+/*
+SNSの通知を受け付けるHTTPハンドラ
+
+署名を確認し、サブスクリプションの確認には自動で応答する。通知はOnNotificationに渡す
+*/
+type Receiver struct {
+	Verifier Verifier
+
+	// 受け付けるトピックのARN。空なら全て受け付ける
+	TopicArn string
+
+	Logger *log.Logger
+
+	// 署名を確認した通知を受け取る。時間のかかる処理はここでは行わないこと
+	OnNotification func(m *Message)
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m Message
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize)).Decode(&m)
+	if err != nil {
+		r.Logger.Printf("SNSメッセージを解析できません(%v)", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err = r.Verifier.Verify(&m)
+	if err != nil {
+		r.Logger.Printf("SNSメッセージの署名を確認できません(%v)", err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.TopicArn != "" && m.TopicArn != r.TopicArn {
+		r.Logger.Printf("設定と違うトピックのメッセージを無視します: %s", m.TopicArn)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch m.Type {
+	case TYPE_SUBSCRIPTION_CONFIRMATION:
+		err = r.confirm(&m)
+		if err != nil {
+			r.Logger.Printf("%s: サブスクリプションの確認に失敗しました(%v)", m.TopicArn, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		r.Logger.Printf("%s: サブスクリプションを確認しました", m.TopicArn)
+	case TYPE_UNSUBSCRIBE_CONFIRMATION:
+		r.Logger.Printf("%s: サブスクリプションが解除されました", m.TopicArn)
+	case TYPE_NOTIFICATION:
+		if r.OnNotification != nil {
+			r.OnNotification(&m)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+SubscribeURLにアクセスしてサブスクリプションを確認する
+*/
+func (r *Receiver) confirm(m *Message) error {
+	err := checkSNSURL(m.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	_, err = get(r.Verifier.Client, m.SubscribeURL)
+	return err
+}
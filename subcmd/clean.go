@@ -45,6 +45,8 @@ func Clean(config *util.Config) error {
 
 			if info.IsDir() {
 				dirList = append(dirList, path)
+			} else if config.Stopping() {
+				return ErrStopped
 			} else {
 				err = cleanFile(config, path, relPath)
 			}
@@ -68,7 +70,20 @@ func cleanFile(config *util.Config, fullPath, relPath string) error {
 	if err != nil {
 		return err
 	}
+	if ent == nil {
+		// まだカタログに登録されていない
+		return nil
+	}
 	if ent.Lock == 0 {
+		replicas, err := model.FindReplicasByEntryId(config.Database, ent.Id)
+		if err != nil {
+			return err
+		}
+		if len(replicas) < config.Replicas() {
+			fmt.Printf("%v: コピー数が%d/%dのため削除しません。\n", relPath, len(replicas), config.Replicas())
+			return nil
+		}
+
 		md5file, err := util.GetMD5(fullPath)
 		if err != nil {
 			return err
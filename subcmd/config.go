@@ -0,0 +1,38 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/rami1942/glaman/util"
+	"sort"
+)
+
+/*
+configテーブルの参照/設定
+
+keyが空なら一覧、valueが空ならその値を表示する
+*/
+func Config(config *util.Config, key, value string) error {
+	if key == "" {
+		values := config.Values()
+		var keys []string
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := values[k]
+			if k == "password" {
+				v = "********"
+			}
+			fmt.Printf("%s\t%s\n", k, v)
+		}
+		return nil
+	}
+
+	if value == "" {
+		fmt.Printf("%s\n", config.Value(key, ""))
+		return nil
+	}
+
+	return config.SetValue(key, value)
+}
@@ -0,0 +1,207 @@
+package subcmd
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/util"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	DAEMON_STATE_IDLE    = "idle"
+	DAEMON_STATE_RUNNING = "running"
+	DAEMON_STATE_STOPPED = "stopped"
+)
+
+/*
+daemonで定期的に実行する処理
+*/
+type daemonTask struct {
+	Name         string
+	Interval     string
+	LastRun      *time.Time `json:",omitempty"`
+	LastDuration string     `json:",omitempty"`
+	LastError    string     `json:",omitempty"`
+	NextRun      time.Time
+
+	interval time.Duration
+	run      func(config *util.Config) error
+}
+
+/*
+状態ファイルに書き出すdaemonの状態
+*/
+type daemonStatus struct {
+	Pid        int
+	Started    time.Time
+	Updated    time.Time
+	State      string
+	Current    string `json:",omitempty"`
+	Tasks      []*daemonTask
+	Retries    backend.RetryStats
+	statusFile string
+}
+
+/*
+常駐してアップロード・取得・不要ファイルの削除を定期的に行う
+
+実行間隔はconfigテーブルのdaemon_sync_interval(既定1h)、daemon_retrieve_interval(既定10m)、
+daemon_clean_interval(既定は実行しない)で設定する。SIGTERM/SIGINTを受けると処理中のファイルが
+終わったところで止まる
+*/
+func Daemon(config *util.Config, statusFile string) error {
+	tasks, err := daemonTasks(config)
+	if err != nil {
+		return err
+	}
+
+	st := &daemonStatus{
+		Pid:        os.Getpid(),
+		Started:    time.Now(),
+		State:      DAEMON_STATE_IDLE,
+		Tasks:      tasks,
+		statusFile: statusFile,
+	}
+
+	defer stopOnSignal(config)()
+
+	for _, t := range tasks {
+		config.Logger.Printf("%s: %s毎に実行します", t.Name, t.Interval)
+	}
+
+	for {
+		next := tasks[0]
+		for _, t := range tasks {
+			if t.NextRun.Before(next.NextRun) {
+				next = t
+			}
+		}
+		err = st.write()
+		if err != nil {
+			config.Logger.Printf("%+v", err)
+		}
+
+		timer := time.NewTimer(time.Until(next.NextRun))
+		select {
+		case <-config.Stop:
+			timer.Stop()
+			return st.stopped(config)
+		case <-timer.C:
+		}
+
+		st.State = DAEMON_STATE_RUNNING
+		st.Current = next.Name
+		err = st.write()
+		if err != nil {
+			config.Logger.Printf("%+v", err)
+		}
+
+		start := time.Now()
+		err = next.run(config)
+		next.LastRun = &start
+		next.LastDuration = time.Since(start).Round(time.Second).String()
+		next.NextRun = time.Now().Add(next.interval)
+		next.LastError = ""
+		if errors.Cause(err) == ErrStopped {
+			return st.stopped(config)
+		} else if err != nil {
+			next.LastError = err.Error()
+			config.Logger.Printf("%s: %+v", next.Name, err)
+		}
+		st.State = DAEMON_STATE_IDLE
+		st.Current = ""
+	}
+}
+
+/*
+SIGTERM/SIGINTを受けたらconfig.Stopを閉じる。戻り値はシグナルの受け取りをやめる関数
+
+2回目のシグナルでは待たずに終了する。未完了のアップロードは次回再開できる
+*/
+func stopOnSignal(config *util.Config) func() {
+	config.Stop = make(chan struct{})
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-sig
+		config.Logger.Printf("%vを受け取りました。処理中のファイルが終わったら終了します", s)
+		close(config.Stop)
+		s = <-sig
+		config.Logger.Printf("%vを受け取りました。強制終了します", s)
+		os.Exit(1)
+	}()
+	return func() { signal.Stop(sig) }
+}
+
+/*
+configテーブルの設定から実行する処理の一覧を作る。間隔が0のものは実行しない
+*/
+func daemonTasks(config *util.Config) ([]*daemonTask, error) {
+	defs := []struct {
+		name, key, def string
+		run            func(config *util.Config) error
+	}{
+		{"sync", "daemon_sync_interval", "1h", func(config *util.Config) error {
+			err := checkUpl(config, true)
+			if err != nil {
+				return err
+			}
+			return checkReplica(config, true)
+		}},
+		{"retrieve", "daemon_retrieve_interval", "10m", func(config *util.Config) error {
+			return checkDown(config, true)
+		}},
+		{"clean", "daemon_clean_interval", "0s", Clean},
+	}
+
+	var tasks []*daemonTask
+	now := time.Now()
+	for _, d := range defs {
+		v := config.Value(d.key, d.def)
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%sの形式が不正です", d.key)
+		}
+		if interval <= 0 {
+			continue
+		}
+		tasks = append(tasks, &daemonTask{Name: d.name, Interval: v, NextRun: now, interval: interval, run: d.run})
+	}
+	if len(tasks) == 0 {
+		return nil, errors.New("実行する処理がありません")
+	}
+	return tasks, nil
+}
+
+func (st *daemonStatus) stopped(config *util.Config) error {
+	st.State = DAEMON_STATE_STOPPED
+	st.Current = ""
+	config.Logger.Printf("終了しました")
+	return st.write()
+}
+
+/*
+状態ファイルを書き換える。読み手が書きかけのファイルを読まないよう一時ファイルから置き換える
+*/
+func (st *daemonStatus) write() error {
+	if st.statusFile == "" {
+		return nil
+	}
+	st.Updated = time.Now()
+	st.Retries = backend.Stats()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := st.statusFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, st.statusFile))
+}
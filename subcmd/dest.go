@@ -0,0 +1,61 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+)
+
+/*
+保存先一覧
+*/
+func DestList(config *util.Config) error {
+	dests, err := config.Destinations()
+	if err != nil {
+		return err
+	}
+	for _, d := range dests {
+		loc := d.Vault
+		if d.Backend == util.BACKEND_LOCAL {
+			loc = d.LocalDir
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d\n", d.Name, d.Backend, d.Region, loc, d.StorageClass, d.Cost)
+	}
+	fmt.Printf("必要なコピー数: %d\n", config.Replicas())
+	return nil
+}
+
+/*
+保存先の追加。costが負なら保存先の種類ごとの既定値を使う
+*/
+func DestAdd(config *util.Config, d model.Destination) error {
+	if d.Name == model.DEFAULT_DESTINATION {
+		return errors.Errorf("%sは既定の保存先の名前なので使えません", d.Name)
+	}
+	if d.Cost < 0 {
+		d.Cost = util.DefaultCost(d.Backend)
+	}
+
+	// 実際に使えるかを確認してから登録する
+	_, err := config.BackendFor(d)
+	if err != nil {
+		return err
+	}
+	return model.InsertDestination(config.Database, d)
+}
+
+/*
+保存先の削除。コピーが残っている場合は削除しない
+*/
+func DestRemove(config *util.Config, name string) error {
+	var n int
+	err := config.Database.QueryRow("select count(*) from replica where destination=?", name).Scan(&n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n > 0 {
+		return errors.Errorf("%sには%d個のコピーがあるため削除できません", name, n)
+	}
+	return model.DeleteDestination(config.Database, name)
+}
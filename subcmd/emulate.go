@@ -0,0 +1,28 @@
+package subcmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/glacier-emulator"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+Glacier APIエミュレータの起動
+*/
+func Emulate(logger *log.Logger, addr, dir string, jobDelay time.Duration, failRate, throttleRate float64) error {
+	srv, err := glacier_emulator.New(glacier_emulator.Options{
+		Dir:          dir,
+		JobDelay:     jobDelay,
+		FailRate:     failRate,
+		ThrottleRate: throttleRate,
+		Logger:       logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Glacier emulator listening on %s (dir=%s)", addr, dir)
+	return errors.WithStack(http.ListenAndServe(addr, srv))
+}
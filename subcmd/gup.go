@@ -7,8 +7,12 @@ import (
 )
 
 func Gup(cfg *util.Config, files []string) (err error) {
+	be, err := cfg.Backend()
+	if err != nil {
+		return
+	}
 	for _, fileName := range files {
-		err = cntmgr.RegisterToArchive(cfg.Logger, cfg.Database, ".", fileName, cfg.VaultName, cfg.Region, cfg.Key)
+		err = cntmgr.RegisterToArchive(cfg.Logger, cfg.Database, be, cfg.DefaultDestination(), ".", fileName, cfg.Key)
 		if err != nil {
 			fmt.Printf("upload failed. skip..(%+v)\n", err)
 		}
@@ -0,0 +1,175 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+)
+
+const (
+	FIX_CATALOG = "catalog"
+	FIX_VAULT   = "vault"
+	FIX_SIZE    = "size"
+)
+
+/*
+インベントリの取得とカタログとの突き合わせ
+
+1回目の実行でインベントリ取得ジョブを発行し、ジョブ完了後の実行で結果を取得して突き合わせる
+*/
+func Inventory(config *util.Config, destName string, fixes []string) error {
+	dest, err := config.Destination(destName)
+	if err != nil {
+		return err
+	}
+	be, err := config.BackendFor(*dest)
+	if err != nil {
+		return err
+	}
+
+	req, err := model.FindInventoryRequest(config.Database, dest.Name)
+	if err != nil {
+		return err
+	}
+	if req == nil {
+		jobId, err := be.RequestInventory()
+		if err != nil {
+			return err
+		}
+		err = model.InsertInventoryRequest(config.Database, dest.Name, jobId)
+		if err != nil {
+			return err
+		}
+		req = &model.InventoryRequest{Destination: dest.Name, JobId: jobId}
+		config.Logger.Printf("%v: インベントリ取得要求を出しました", dest.Name)
+	}
+
+	inv, err := be.Inventory(req.JobId)
+	if err == backend.ErrJobNotComplete {
+		config.Logger.Printf("%v: インベントリ取得ジョブがまだ完了していません。もうしばらくしてから実行してください(開始時刻=%s)",
+			dest.Name, req.StartDt.Format("2006/01/02 15:04:05"))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = reconcile(config, *dest, be, inv, fixes)
+	if err != nil {
+		return err
+	}
+	return model.DeleteInventoryRequest(config.Database, dest.Name)
+}
+
+func reconcile(config *util.Config, dest model.Destination, be backend.Backend, inv *backend.Inventory, fixes []string) error {
+	fix := map[string]bool{}
+	for _, f := range fixes {
+		fix[f] = true
+	}
+
+	fmt.Printf("インベントリ日時: %s\n", inv.InventoryDate.Local().Format("2006/01/02 15:04:05"))
+
+	inVault := map[string]backend.Archive{}
+	for _, a := range inv.Archives {
+		inVault[a.ArchiveId] = a
+	}
+
+	replicas, err := model.FindReplicasByDestination(config.Database, dest.Name)
+	if err != nil {
+		return err
+	}
+
+	inCatalog := map[string]bool{}
+	for _, r := range replicas {
+		inCatalog[r.ArchiveId] = true
+
+		entry, err := model.FindEntryById(config.Database, r.EntryId)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+
+		a, ok := inVault[r.ArchiveId]
+		if !ok {
+			// インベントリ作成後にアップロードしたものはまだ載っていない
+			if r.UploadDt.After(inv.InventoryDate) {
+				continue
+			}
+			fmt.Printf("CATALOG_ONLY\t%s\t%s\t%s\n", dest.Name, entry.Name, r.ArchiveId)
+			if fix[FIX_CATALOG] {
+				err = dropReplica(config, *entry, r)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if a.Size != entry.Size {
+			fmt.Printf("SIZE_MISMATCH\t%s\t%s\t%d\t%d\n", dest.Name, entry.Name, entry.Size, a.Size)
+			if fix[FIX_SIZE] {
+				err = be.DeleteArchive(r.ArchiveId)
+				if err != nil {
+					return err
+				}
+				err = dropReplica(config, *entry, r)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, a := range inv.Archives {
+		if inCatalog[a.ArchiveId] {
+			continue
+		}
+		fmt.Printf("VAULT_ONLY\t%s\t%s\t%d\t%s\n", dest.Name, a.ArchiveId, a.Size, a.CreationDate.Local().Format("2006/01/02 15:04:05"))
+		if fix[FIX_VAULT] {
+			err = be.DeleteArchive(a.ArchiveId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+存在しないコピーをカタログから外す
+
+コピーが1つも残らない場合はエントリごと削除する。元ファイルが手元にあれば次のsyncで登録し直される
+*/
+func dropReplica(config *util.Config, entry model.FileEntry, r model.Replica) error {
+	err := model.DeleteReplica(config.Database, r.Id)
+	if err != nil {
+		return err
+	}
+
+	rest, err := model.FindReplicasByEntryId(config.Database, entry.Id)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		if entry.ArchiveId == r.ArchiveId {
+			return model.UpdateArchiveId(config.Database, entry.Id, rest[0].ArchiveId)
+		}
+		return nil
+	}
+
+	config.Logger.Printf("%v: コピーが残っていないためカタログから削除します", entry.Name)
+	tx, err := config.Database.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = model.DeleteEntry(tx, entry.Id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.WithStack(tx.Commit())
+}
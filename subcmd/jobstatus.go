@@ -1,38 +1,104 @@
 package subcmd
 
 import (
-	"database/sql"
 	"fmt"
 	"github.com/rami1942/glaman/model"
 	"github.com/rami1942/glaman/util"
-	"time"
 )
 
 func JobStatus(config *util.Config) error {
 
-	mgr, err := config.GlacierManager()
+	dests, err := config.Destinations()
 	if err != nil {
 		return err
 	}
 
-	jobs, err := mgr.JobList()
+	for _, d := range dests {
+		be, err := config.BackendFor(d)
+		if err != nil {
+			return err
+		}
+
+		jobs, err := be.JobList()
+		if err != nil {
+			return err
+		}
+
+		for _, j := range jobs {
+			t := j.CreationDate.Local()
+			tier := j.Tier
+			if tier == "" {
+				// S3はティアを返さない
+				tier = "-"
+			}
+
+			entry, err := model.FindEntryByArchiveId(config.Database, j.ArchiveId)
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				fmt.Printf("UNKNOWN %s %s %s %s\n", j.StatusCode, tier, t.Format("2006/01/02 15:04:05"), d.Name)
+				continue
+			}
+
+			fmt.Printf("%s %s %s %s %s\n", entry.Name, j.StatusCode, tier, t.Format("2006/01/02 15:04:05"), d.Name)
+		}
+	}
+
+	err = requestStatus(config)
 	if err != nil {
 		return err
 	}
+	return replicaStatus(config)
+}
 
-	for _, j := range jobs {
-		entry, err := model.FindEntryByArchiveId(config.Database, *j.ArchiveId)
-		if err == sql.ErrNoRows {
-			fmt.Printf("UNKNOWN %s %s %s\n", *j.StatusCode, *j.Tier, *j.CreationDate)
-		} else if err != nil {
+/*
+発行済みの取得要求を表示する
+*/
+func requestStatus(config *util.Config) error {
+	requests, err := model.AllRequests(config.Database)
+	if err != nil {
+		return err
+	}
+	for _, ex := range requests {
+		entry, err := model.FindEntryById(config.Database, ex.Id)
+		if err != nil {
 			return err
 		}
+		if entry == nil {
+			continue
+		}
+		tier := ex.Tier
+		if tier == "" {
+			tier = "-"
+		}
+		fmt.Printf("REQUEST %s %s %s %s\n", entry.Name, tier, ex.StartDt.Format("2006/01/02 15:04:05"), ex.Destination)
+	}
+	return nil
+}
 
-		utct, err := time.Parse("2006-01-02T15:04:05.999Z", *j.CreationDate)
-		t := utct.Local()
-
-		fmt.Printf("%s %s %s %s\n", entry.Name, *j.StatusCode, *j.Tier, t.Format("2006/01/02 15:04:05"))
+/*
+コピー数が足りていないファイルを表示する
+*/
+func replicaStatus(config *util.Config) error {
+	entries, err := model.AllEntry(config.Database)
+	if err != nil {
+		return err
 	}
+	counts, err := model.ReplicaCounts(config.Database)
+	if err != nil {
+		return err
+	}
+	required := config.Replicas()
 
+	complete := 0
+	for _, e := range entries {
+		if counts[e.Id] >= required {
+			complete++
+			continue
+		}
+		fmt.Printf("REPLICA %s %d/%d\n", e.Name, counts[e.Id], required)
+	}
+	fmt.Printf("複製完了: %d/%d ファイル\n", complete, len(entries))
 	return nil
 }
@@ -0,0 +1,139 @@
+package subcmd
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/sns-receiver"
+	"github.com/rami1942/glaman/util"
+	"net/http"
+	"time"
+)
+
+const (
+	// 処理待ちの完了通知の上限
+	listenQueueSize = 100
+
+	// 待ち受けのタイムアウト。署名の確認で証明書を取得するので書き込みは長めにする
+	listenReadTimeout  = 10 * time.Second
+	listenWriteTimeout = 30 * time.Second
+	listenIdleTimeout  = 60 * time.Second
+)
+
+/*
+Glacierのジョブ完了通知(SNSメッセージのMessage)
+*/
+type jobNotification struct {
+	JobId         string
+	Action        string
+	ArchiveId     string
+	Completed     bool
+	StatusCode    string
+	StatusMessage string
+}
+
+/*
+SNSの通知を待ち受け、取得ジョブが完了したらその場でダウンロード・復号する
+
+通知は受け付けた順に1つずつ処理する。certFileを指定すると署名の確認にその証明書を使う
+*/
+func Listen(config *util.Config, addr, certFile string) error {
+	topic := config.SNSTopic()
+	if topic == "" {
+		// 署名だけでは誰のトピックからのメッセージか分からないので、トピックの指定を必須にする
+		return errors.New("sns_topicが設定されていません。glaman config sns_topic <トピックのARN> で設定してください")
+	}
+
+	r := &sns_receiver.Receiver{
+		TopicArn: topic,
+		Logger:   config.Logger,
+	}
+	if certFile != "" {
+		cert, err := sns_receiver.LoadCert(certFile)
+		if err != nil {
+			return err
+		}
+		r.Verifier.Cert = cert
+	}
+
+	jobs := make(chan jobNotification, listenQueueSize)
+	r.OnNotification = func(m *sns_receiver.Message) {
+		var j jobNotification
+		err := json.Unmarshal([]byte(m.Message), &j)
+		if err != nil || j.JobId == "" {
+			config.Logger.Printf("ジョブの完了通知ではないメッセージを無視します(%s)", m.MessageId)
+			return
+		}
+		select {
+		case jobs <- j:
+		default:
+			config.Logger.Printf("%s: 処理待ちの通知が多すぎるため無視します。glaman sync -r で取得してください", j.JobId)
+		}
+	}
+
+	go func() {
+		for j := range jobs {
+			err := onJobCompleted(config, j)
+			if err != nil {
+				config.Logger.Printf("%s: %+v", j.JobId, err)
+			}
+		}
+	}()
+
+	config.Logger.Printf("SNSの通知を%sで待ち受けます(トピック=%s)", addr, topic)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           r,
+		ReadHeaderTimeout: listenReadTimeout,
+		ReadTimeout:       listenReadTimeout,
+		WriteTimeout:      listenWriteTimeout,
+		IdleTimeout:       listenIdleTimeout,
+	}
+	return errors.WithStack(srv.ListenAndServe())
+}
+
+/*
+ジョブの完了通知を受けて、対応する取得要求のダウンロード・復号を行う
+*/
+func onJobCompleted(config *util.Config, j jobNotification) error {
+	if j.Action != "ArchiveRetrieval" {
+		config.Logger.Printf("%s: %sジョブが完了しました", j.JobId, j.Action)
+		return nil
+	}
+
+	ex, err := model.FindExRequestByJobId(config.Database, j.JobId)
+	if err != nil {
+		return err
+	}
+	if ex == nil {
+		// glaman peekの範囲取得やglaman restoreの版の取得など、syncが出したものではないジョブ
+		config.Logger.Printf("%s: 取得要求が見つからないジョブのため無視します", j.JobId)
+		return nil
+	}
+	entry, err := model.FindEntryById(config.Database, ex.Id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return model.DeleteRequest(config.Database, ex.Id)
+	}
+
+	if j.StatusCode != "Succeeded" {
+		// 取得要求を消して次回のsyncで出し直す
+		config.Logger.Printf("%v: 取得ジョブが失敗しました(%s)。次回のsyncで取得要求を出し直します", entry.Name, j.StatusMessage)
+		return model.DeleteRequest(config.Database, ex.Id)
+	}
+
+	target, err := pathToRetrieve(config, entry.Id)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		config.Logger.Printf("%v: 取得の必要が無くなったため無視します", entry.Name)
+		return nil
+	}
+	entry = target
+
+	config.Logger.Printf("%v: 取得ジョブが完了しました", entry.Name)
+	return retrieve(config, *ex, *entry)
+}
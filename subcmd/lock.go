@@ -1,16 +1,112 @@
 package subcmd
 
 import (
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
 	"github.com/rami1942/glaman/model"
 	"github.com/rami1942/glaman/util"
+	"time"
 )
 
-func Lock(config *util.Config, ids []int64, lockValue int) error {
+/*
+ロック/アンロック
+
+同じ内容のファイルが複数のパスにあれば、全てのパスをロック/アンロックする。ロック時にはtier(取得の速さ)かneedBy(取得完了の期限)を指定できる
+*/
+func Lock(config *util.Config, ids []int64, lockValue int, tier, needBy string) error {
+	opt := model.LockOption{}
+	if tier != "" {
+		t, err := backend.ParseTier(tier)
+		if err != nil {
+			return err
+		}
+		opt.Tier = t
+	}
+	if needBy != "" {
+		t, err := parseNeedBy(needBy, time.Now())
+		if err != nil {
+			return err
+		}
+		opt.NeedBy = t
+	}
+
 	for _, i := range ids {
 		err := model.UpdateLock(config.Database, i, lockValue)
 		if err != nil {
 			return err
 		}
+
+		if lockValue == 0 || (opt.Tier == "" && opt.NeedBy.IsZero()) {
+			err = model.DeleteLockOption(config.Database, i)
+		} else {
+			opt.Id = i
+			err = model.UpdateLockOption(config.Database, opt)
+		}
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// 日時指定で受け付ける形式
+var dateLayouts = []string{"2006/01/02 15:04", "2006-01-02 15:04", "2006/01/02", "2006-01-02", time.RFC3339}
+
+/*
+期限の解釈。"6h"のような現在からの時間か、"2006/01/02 15:04"形式の日時
+*/
+func parseNeedBy(s string, now time.Time) (time.Time, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		return now.Add(d), nil
+	}
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("期限の形式が不正です: %s", s)
+}
+
+/*
+取得要求に使うティアを決める
+
+期限が指定されていればそれに間に合う最も安いティア、そうでなければロック時の指定か設定の既定値
+*/
+func retrievalTier(config *util.Config, entry model.FileEntry, be backend.Backend) (string, error) {
+	opt, err := model.FindLockOption(config.Database, entry.Id)
+	if err != nil {
+		return "", err
+	}
+
+	if opt != nil && !opt.NeedBy.IsZero() {
+		te, ok := be.(backend.TierEstimator)
+		if !ok {
+			return backend.TIER_STANDARD, nil
+		}
+		tier, err := backend.ChooseTier(te.TierDurations(), time.Now(), opt.NeedBy)
+		if err == backend.ErrNoTierInTime {
+			tier = backend.FastestTier(te.TierDurations())
+			config.Logger.Printf("%v: 期限(%s)に間に合うティアがありません。%sで取得します",
+				entry.Name, opt.NeedBy.Format("2006/01/02 15:04"), tier)
+			return tier, nil
+		}
+		return tier, err
+	}
+
+	if opt != nil && opt.Tier != "" {
+		return opt.Tier, nil
+	}
+	return backend.ParseTier(config.Value("tier", backend.TIER_STANDARD))
+}
+
+/*
+指定されたティアか、省略時は設定の既定値
+*/
+func tierOrDefault(config *util.Config, tier string) (string, error) {
+	if tier == "" {
+		tier = config.Value("tier", backend.TIER_STANDARD)
+	}
+	return backend.ParseTier(tier)
+}
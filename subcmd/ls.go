@@ -11,31 +11,39 @@ import (
 func Ls(config *util.Config, showComment bool, showLock bool) (err error) {
 	switch {
 	case showLock:
-		err = lsLock(config.Database)
+		err = lsLock(config)
 	case showComment:
 		err = lsComment(config.Database)
 	default:
-		err = lsNormal(config.Database)
+		err = lsNormal(config)
 	}
 	return err
 }
 
-func lsNormal(db *sql.DB) (err error) {
-	return listNormal(model.AllEntry(db))
+func lsNormal(config *util.Config) (err error) {
+	entry, err := model.AllEntry(config.Database)
+	return listNormal(config, entry, err)
 }
 
-func lsLock(db *sql.DB) error {
-	return listNormal(model.LockedEntry(db))
+func lsLock(config *util.Config) error {
+	entry, err := model.LockedEntry(config.Database)
+	return listNormal(config, entry, err)
 }
 
-func listNormal(entry []model.FileEntry, err error) error {
+func listNormal(config *util.Config, entry []model.FileEntry, err error) error {
 	if err != nil {
 		return err
 	}
+	counts, err := model.ReplicaCounts(config.Database)
+	if err != nil {
+		return err
+	}
+	required := config.Replicas()
+
 	for _, e := range entry {
 		t := time.Unix(0, e.Mtime)
 
-		fmt.Printf("%d\t%s\t%d\t%s\n", e.Id, e.Name, e.Size, t.Format("2006/01/02 15:04:05"))
+		fmt.Printf("%d\t%s\t%d\t%s\t%d/%d\n", e.Id, e.Name, e.Size, t.Format("2006/01/02 15:04:05"), counts[e.Id], required)
 	}
 	return nil
 }
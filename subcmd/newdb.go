@@ -1,12 +1,35 @@
 package subcmd
 
 import (
+	"bufio"
 	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/glacier-manager"
+	"github.com/rami1942/glaman/util"
 	"log"
 	"os"
+	"strings"
 )
 
-func NewDB(logger *log.Logger, fileName, region, vault, basedir, password string) (err error) {
+func NewDB(logger *log.Logger, fileName, region, vault, basedir, password, backendType, localDir, endpoint string, createVault bool) (err error) {
+
+	switch backendType {
+	case util.BACKEND_GLACIER, util.BACKEND_S3:
+		if region == "" || vault == "" {
+			return errors.New("--regionと--vaultを指定してください")
+		}
+	case util.BACKEND_GCS:
+		if vault == "" {
+			return errors.New("--vaultを指定してください")
+		}
+	case util.BACKEND_LOCAL:
+		if localDir == "" {
+			return errors.New("--localdirを指定してください")
+		}
+	default:
+		return errors.Errorf("未対応の保存先です: %s", backendType)
+	}
 
 	// すでに存在していたらエラーにする
 	_, err = os.Stat(fileName)
@@ -16,6 +39,13 @@ func NewDB(logger *log.Logger, fileName, region, vault, basedir, password string
 		return
 	}
 
+	if backendType == util.BACKEND_GLACIER {
+		err = ensureVault(logger, region, vault, endpoint, createVault)
+		if err != nil {
+			return
+		}
+	}
+
 	db, err := sql.Open("sqlite3", fileName)
 	if err != nil {
 		logger.Printf("sql.Open failed.")
@@ -36,7 +66,56 @@ func NewDB(logger *log.Logger, fileName, region, vault, basedir, password string
 		return
 	}
 
-	_, err = db.Exec("insert into config (k, v) values ('region', ?), ('vault', ?), ('basedir', ?), ('password', ?)", region, vault, basedir, password)
+	_, err = db.Exec("insert into config (k, v) values ('region', ?), ('vault', ?), ('basedir', ?), ('password', ?), ('backend', ?)", region, vault, basedir, password, backendType)
+	if err != nil {
+		return
+	}
+
+	if localDir != "" {
+		_, err = db.Exec("insert into config (k, v) values ('localdir', ?)", localDir)
+		if err != nil {
+			return
+		}
+	}
+	if endpoint != "" {
+		_, err = db.Exec("insert into config (k, v) values ('endpoint', ?)", endpoint)
+	}
 
 	return
 }
+
+/*
+vaultが存在するか確認し、無ければ作成する
+
+createVaultがfalseの場合は作成してよいか確認する
+*/
+func ensureVault(logger *log.Logger, region, vault, endpoint string, createVault bool) error {
+	gmgr, err := glacier_manager.NewWithEndpoint("-", vault, region, endpoint)
+	if err != nil {
+		return err
+	}
+
+	_, err = gmgr.DescribeVault(vault)
+	if err == nil {
+		return nil
+	}
+	if err != glacier_manager.ErrVaultNotFound {
+		return errors.WithMessage(err, "vaultの確認に失敗しました")
+	}
+
+	if !createVault {
+		fmt.Printf("vault %s (%s) が存在しません。作成しますか? [y/N] ", vault, region)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(line)) != "y" {
+			logger.Printf("vaultは作成しません。glaman vault createで後から作成できます")
+			return nil
+		}
+	}
+
+	err = gmgr.CreateVault(vault)
+	if err != nil {
+		return err
+	}
+	logger.Printf("vault %s を作成しました", vault)
+	return nil
+}
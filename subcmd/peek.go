@@ -0,0 +1,190 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ファイルの一部だけを取得する
+
+1回目の実行で範囲を1MB境界に広げた取得要求を出し、ジョブ完了後の実行でその部分だけを復号して
+要求された範囲をoutに書き出す。outを省略した場合はカレントディレクトリの"<ファイル名>.<from>-<to>"
+*/
+func Peek(config *util.Config, id int64, rangeSpec, out, tier string) error {
+	entry, err := model.FindEntryById(config.Database, id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return errors.Errorf("ID %d のエントリがありません", id)
+	}
+	if entry.ArchiveId == "" {
+		return errors.Errorf("%v: アップロードが完了していません", entry.Name)
+	}
+
+	from, to, err := parsePeekRange(rangeSpec, entry.Size)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		out = fmt.Sprintf("%s.%d-%d", filepath.Base(entry.Name), from, to)
+	}
+	// 保存先はダウンロード先のディレクトリを作るので絶対パスにしておく
+	out, err = filepath.Abs(out)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := model.FindRangeRequest(config.Database, entry.Id, from, to)
+	if err != nil {
+		return err
+	}
+	if req == nil {
+		req, err = requestRange(config, *entry, from, to, tier)
+		if err != nil {
+			return err
+		}
+	}
+
+	dest, err := config.Destination(req.Destination)
+	if err != nil {
+		return err
+	}
+	be, err := config.BackendFor(*dest)
+	if err != nil {
+		return err
+	}
+
+	cryptFile := out + ".enc"
+	defer os.Remove(cryptFile)
+
+	// チャンクごとのツリーハッシュはDownloadFileで確認している
+	err = be.DownloadFile(config.Logger, req.JobId, cryptFile)
+	if err == backend.ErrJobNotComplete {
+		config.Logger.Printf("%v: 範囲取得ジョブがまだ完了していません。もうしばらくしてから実行してください(開始時刻=%s)",
+			entry.Name, req.StartDt.Format("2006/01/02 15:04:05"))
+		return nil
+	} else if err == backend.ErrJobExpired {
+		config.Logger.Printf("%v: 範囲取得ジョブの期限が切れています。もう一度実行すると取得要求を出し直します", entry.Name)
+		return model.DeleteRangeRequest(config.Database, req.Id)
+	} else if err != nil {
+		return err
+	}
+	config.Logger.Printf("DL終了。復号中..")
+
+	iv, err := model.GetIV(config.Database, entry.Id)
+	if err != nil {
+		return err
+	}
+	jobFrom, _ := backend.AlignRange(from, to, entry.Size)
+	err = util.DecryptRange(cryptFile, out, config.Key, iv, jobFrom, from-jobFrom, to-from+1)
+	if err != nil {
+		return err
+	}
+
+	err = model.DeleteRangeRequest(config.Database, req.Id)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("%v: %d-%dバイト目を%sに書き出しました", entry.Name, from, to, out)
+	return nil
+}
+
+/*
+範囲取得に対応した保存先を探して取得要求を出す
+*/
+func requestRange(config *util.Config, entry model.FileEntry, from, to int64, tier string) (*model.RangeRequest, error) {
+	tier, err := tierOrDefault(config, tier)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := retrievalSources(config, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	jobFrom, jobTo := backend.AlignRange(from, to, entry.Size)
+	for _, src := range sources {
+		be, err := config.BackendFor(src.dest)
+		if err != nil {
+			config.Logger.Printf("%v: 保存先%vが使用できません(%v)", entry.Name, src.dest.Name, err)
+			continue
+		}
+		rr, ok := be.(backend.RangeRetriever)
+		if !ok {
+			config.Logger.Printf("%v: 保存先%vは範囲取得に対応していません", entry.Name, src.dest.Name)
+			continue
+		}
+
+		jobId, err := rr.RequestRetrieveRange(src.archiveId, tier, jobFrom, jobTo)
+		if err != nil {
+			config.Logger.Printf("%v: %vへの範囲取得要求に失敗しました(%v)", entry.Name, src.dest.Name, err)
+			continue
+		}
+		err = model.InsertRangeRequest(config.Database, entry.Id, from, to, src.dest.Name, jobId)
+		if err != nil {
+			return nil, err
+		}
+		config.Logger.Printf("%v: %vに%d-%dバイト目の取得要求を出しました(%v)", entry.Name, src.dest.Name, jobFrom, jobTo, tier)
+		return model.FindRangeRequest(config.Database, entry.Id, from, to)
+	}
+	return nil, errors.Errorf("%v: 範囲取得できるコピーがありません", entry.Name)
+}
+
+/*
+範囲の解釈。"from-to"形式で両端を含む。toを省略するとファイルの末尾まで
+
+数値にはK, M, G(1024単位)を付けられる。toはファイルの末尾で切り詰める
+*/
+func parsePeekRange(s string, size int64) (int64, int64, error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return 0, 0, errors.Errorf("範囲の形式が不正です: %s", s)
+	}
+	from, err := parseByteSize(s[:i])
+	if err != nil {
+		return 0, 0, err
+	}
+	to := size - 1
+	if s[i+1:] != "" {
+		to, err = parseByteSize(s[i+1:])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if to >= size {
+		to = size - 1
+	}
+	if from > to {
+		return 0, 0, errors.Errorf("範囲がファイルの外です: %s(サイズ=%d)", s, size)
+	}
+	return from, to, nil
+}
+
+func parseByteSize(s string) (int64, error) {
+	mul := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			mul = 1024
+		case "M":
+			mul = 1024 * 1024
+		case "G":
+			mul = 1024 * 1024 * 1024
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(s, "KMGkmg"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("バイト数の形式が不正です: %s", s)
+	}
+	return n * mul, nil
+}
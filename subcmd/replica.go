@@ -0,0 +1,127 @@
+package subcmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/cntmgr"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+	"os"
+	"path/filepath"
+)
+
+// 取得元の候補
+type retrievalSource struct {
+	dest      model.Destination
+	archiveId string
+	treeHash  string
+}
+
+/*
+コピー数が設定に満たないエントリを、まだコピーの無い保存先にアップロードする
+*/
+func checkReplica(config *util.Config, doRun bool) error {
+	required := config.Replicas()
+
+	dests, err := config.Destinations()
+	if err != nil {
+		return err
+	}
+	if len(dests) < required {
+		config.Logger.Printf("保存先が%d個しかないため、コピー数%dを満たせません。glaman dest addで保存先を追加してください", len(dests), required)
+	}
+
+	entries, err := model.AllEntry(config.Database)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if config.Stopping() {
+			return ErrStopped
+		}
+		if e.ArchiveId == "" {
+			continue
+		}
+		replicas, err := model.FindReplicasByEntryId(config.Database, e.Id)
+		if err != nil {
+			return err
+		}
+		if len(replicas) >= required {
+			continue
+		}
+
+		// 元ファイルが無いとコピーを作れない
+		fullPath := filepath.Join(config.DocRoot, e.Name)
+		_, err = os.Stat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				config.Logger.Printf("%v: コピー数が%d/%dですが、ファイルが手元に無いため複製できません", e.Name, len(replicas), required)
+				continue
+			}
+			return errors.WithStack(err)
+		}
+
+		have := map[string]bool{}
+		for _, r := range replicas {
+			have[r.Destination] = true
+		}
+
+		n := len(replicas)
+		for _, d := range dests {
+			if n >= required {
+				break
+			}
+			if have[d.Name] {
+				continue
+			}
+
+			if !doRun {
+				config.Logger.Printf("DRY RUN: replicate %v to %v.", e.Name, d.Name)
+				n++
+				continue
+			}
+
+			be, err := config.BackendFor(d)
+			if err != nil {
+				config.Logger.Printf("%v: 保存先%vが使用できません(%v)", e.Name, d.Name, err)
+				continue
+			}
+			err = cntmgr.ReplicateToArchive(config.Logger, config.Database, be, d, config.DocRoot, e, config.Key)
+			if err != nil {
+				config.Logger.Printf("%v: %vへの複製に失敗しました(%+v)", e.Name, d.Name, err)
+				continue
+			}
+			n++
+		}
+	}
+	return nil
+}
+
+/*
+エントリの取得元候補をコストの小さい順に返す
+*/
+func retrievalSources(config *util.Config, entry model.FileEntry) ([]retrievalSource, error) {
+	replicas, err := model.FindReplicasByEntryId(config.Database, entry.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []retrievalSource
+	dests, err := config.Destinations()
+	if err != nil {
+		return nil, err
+	}
+	// destsはコスト順なのでその順に並べる
+	for _, d := range dests {
+		for _, r := range replicas {
+			if r.Destination == d.Name {
+				sources = append(sources, retrievalSource{d, r.ArchiveId, r.TreeHash})
+			}
+		}
+	}
+
+	if len(sources) == 0 && entry.ArchiveId != "" {
+		sources = append(sources, retrievalSource{config.DefaultDestination(), entry.ArchiveId, ""})
+	}
+	return sources, nil
+}
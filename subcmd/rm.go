@@ -0,0 +1,240 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+最低保存期間(日)。これより前に削除しても残りの期間分の料金がかかる
+*/
+func minStorageDays(d model.Destination) int {
+	switch d.Backend {
+	case util.BACKEND_GLACIER:
+		return 90
+	case util.BACKEND_S3:
+		if d.StorageClass == "GLACIER_IR" {
+			return 90
+		}
+		return 180
+	case util.BACKEND_GCS:
+		if d.StorageClass == "ARCHIVE" {
+			return 365
+		}
+		return 90
+	default:
+		return 0
+	}
+}
+
+/*
+アーカイブの削除
+
+selectorはエントリIDかパス(ワイルドカード可)。doRunがfalseなら削除対象と早期削除料金の警告を表示するだけ。
+IDを指定すると全てのパスごと削除する。パスを指定した場合、同じ内容の他のパスが残っていればそのパスだけをカタログから外す
+*/
+func Rm(config *util.Config, selectors []string, doRun bool) error {
+	entries, err := selectEntries(config, selectors)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errors.New("該当するファイルがありません")
+	}
+	if !doRun {
+		config.Logger.Printf("ドライランモードのため、実際の削除は行われません。行うには-rオプションをつけてください。")
+	}
+
+	for _, e := range entries {
+		err = rmEntry(config, e, doRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func selectEntries(config *util.Config, selectors []string) ([]model.FileEntry, error) {
+	var result []model.FileEntry
+	// エントリIDとパスのID。パスのIDが0ならエントリ全体
+	seen := map[[2]int64]bool{}
+	add := func(e model.FileEntry) {
+		if !seen[[2]int64{e.Id, e.PathId}] && !seen[[2]int64{e.Id, 0}] {
+			seen[[2]int64{e.Id, e.PathId}] = true
+			result = append(result, e)
+		}
+	}
+
+	all, err := model.AllEntry(config.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sel := range selectors {
+		if id, err := strconv.ParseInt(sel, 10, 64); err == nil {
+			// IDなら古い版も指定できる
+			e, err := model.FindEntryById(config.Database, id)
+			if err != nil {
+				return nil, err
+			}
+			if e != nil {
+				e.PathId = 0
+				add(*e)
+			}
+			continue
+		}
+		for _, e := range all {
+			ok, err := filepath.Match(sel, e.Name)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if ok {
+				add(e)
+			}
+		}
+	}
+	return result, nil
+}
+
+func rmEntry(config *util.Config, entry model.FileEntry, doRun bool) error {
+	paths, err := model.FindPaths(config.Database, entry.Id)
+	if err != nil {
+		return err
+	}
+	if entry.PathId != 0 && len(paths) > 1 {
+		fmt.Printf("%d\t%s\t%d\n", entry.Id, entry.Name, entry.Size)
+		fmt.Printf("\t同じ内容の他のパスが残っているため、このパスだけをカタログから外します\n")
+		if !doRun {
+			return nil
+		}
+		return model.DeletePath(config.Database, entry.PathId)
+	}
+
+	replicas, err := model.FindReplicasByEntryId(config.Database, entry.Id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d\t%s\t%d\n", entry.Id, entry.Name, entry.Size)
+	for _, p := range paths {
+		if p.Name != entry.Name {
+			fmt.Printf("\t同じ内容のパス: %s\n", p.Name)
+		}
+	}
+	for _, r := range replicas {
+		dest, err := config.Destination(r.Destination)
+		if err != nil {
+			return err
+		}
+		warnEarlyDeletion(*dest, r, entry)
+	}
+
+	for _, p := range paths {
+		_, err = os.Stat(filepath.Join(config.DocRoot, p.Name))
+		if err == nil {
+			fmt.Printf("\t警告: ローカルに%sが残っています。次回のsyncで再度アップロードされます\n", p.Name)
+		}
+	}
+
+	if !doRun {
+		return nil
+	}
+	return deleteArchives(config, entry)
+}
+
+/*
+エントリの全てのコピーを保存先から削除し、カタログから外す
+
+再開待ちのアップロードがあれば先に中止する。エントリを消すと誰も再開・中止しなくなり、料金がかかり続けるため
+*/
+func deleteArchives(config *util.Config, entry model.FileEntry) error {
+	err := abortEntryUpload(config, entry)
+	if err != nil {
+		return err
+	}
+
+	replicas, err := model.FindReplicasByEntryId(config.Database, entry.Id)
+	if err != nil {
+		return err
+	}
+
+	// 保存先から削除できたコピーから順にカタログから外す
+	for _, r := range replicas {
+		dest, err := config.Destination(r.Destination)
+		if err != nil {
+			return err
+		}
+		be, err := config.BackendFor(*dest)
+		if err != nil {
+			return err
+		}
+		err = be.DeleteArchive(r.ArchiveId)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("%v: %vからの削除に失敗しました", entry.Name, r.Destination))
+		}
+		err = model.DeleteReplica(config.Database, r.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := config.Database.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = model.DeleteEntry(tx, entry.Id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	config.Logger.Printf("%v: 削除しました", entry.Name)
+	return nil
+}
+
+func abortEntryUpload(config *util.Config, entry model.FileEntry) error {
+	st, err := model.FindUploadState(config.Database, entry.Id)
+	if err != nil || st == nil || st.UploadId == "" {
+		return err
+	}
+	_, ml, err := multipartLister(config, st.Destination)
+	if err != nil {
+		return err
+	}
+	err = ml.AbortUpload(st.UploadId)
+	if err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("%v: 未完了のアップロードの中止に失敗しました", entry.Name))
+	}
+	config.Logger.Printf("%v: 未完了のアップロードを中止しました: %v", entry.Name, st.UploadId)
+	return nil
+}
+
+func warnEarlyDeletion(dest model.Destination, r model.Replica, entry model.FileEntry) {
+	days := minStorageDays(dest)
+	if days == 0 {
+		return
+	}
+	if r.UploadDt.IsZero() {
+		// replicaテーブル導入前のもの。アップロード日時が分からないので最大の料金を示す
+		fmt.Printf("\t警告: %sへのアップロード日時が不明です。最大%d日分の保存料金(%.2fGB)がかかる可能性があります\n",
+			r.Destination, days, float64(entry.Size)/(1024*1024*1024))
+		return
+	}
+
+	elapsed := time.Since(r.UploadDt)
+	remain := time.Duration(days)*24*time.Hour - elapsed
+	if remain <= 0 {
+		return
+	}
+	fmt.Printf("\t警告: %sへのアップロード(%s)から%d日経っていません。残り%d日分の保存料金(%.2fGB)がかかります\n",
+		r.Destination, r.UploadDt.Format("2006/01/02"), days, int(remain.Hours()/24)+1, float64(entry.Size)/(1024*1024*1024))
+}
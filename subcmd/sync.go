@@ -1,19 +1,32 @@
 package subcmd
 
 import (
+	"crypto/md5"
 	"fmt"
 	"github.com/pkg/errors"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
+	"github.com/rami1942/glaman/backend"
 	"github.com/rami1942/glaman/cntmgr"
 	"github.com/rami1942/glaman/glacier-manager"
 	"github.com/rami1942/glaman/model"
 	"github.com/rami1942/glaman/util"
 )
 
+// 古い版の扱い(configのold_versions)
+const (
+	OLD_VERSIONS_KEEP   = "keep"
+	OLD_VERSIONS_DELETE = "delete"
+)
+
 var (
-	ErrMD5Mismatch = errors.New("md5sum is not matched")
+	ErrMD5Mismatch      = errors.New("md5sum is not matched")
+	ErrTreeHashMismatch = errors.New("tree hash is not matched")
+
+	// 停止要求を受けて処理を中断した
+	ErrStopped = errors.New("stopped")
 )
 
 func Sync(config *util.Config, doRun bool) error {
@@ -21,18 +34,34 @@ func Sync(config *util.Config, doRun bool) error {
 	if !doRun {
 		config.Logger.Printf("ドライランモードのため、実際のアップロード/ダウンロードは行われません。行うには-rオプションをつけてください。")
 	}
+	defer printRetryStats(config)
+
 	config.Logger.Printf("アップロードのチェック")
 	err := checkUpl(config, doRun)
 	if err != nil {
 		return err
 	}
 
+	config.Logger.Printf("コピー数のチェック")
+	err = checkReplica(config, doRun)
+	if err != nil {
+		return err
+	}
+
 	config.Logger.Printf("ダウンロードのチェック")
 	err = checkDown(config, doRun)
 
 	return err
 }
 
+/*
+通信の再試行と失敗の回数を表示する
+*/
+func printRetryStats(config *util.Config) {
+	st := backend.Stats()
+	config.Logger.Printf("再試行: %d回(うちスロットリング: %d回), 失敗: %d回", st.Retries, st.Throttles, st.Failures)
+}
+
 /*
 ディレクトリをスキャンしてGlacierに登録されていなかったら登録する
 */
@@ -49,10 +78,15 @@ func checkUpl(config *util.Config, doRun bool) error {
 			if relPath == "." {
 				return nil
 			}
+			if config.Stopping() {
+				return ErrStopped
+			}
 
 			if info.IsDir() {
 				//				fmt.Printf("d:%v\n", relPath)
 				// Skip
+			} else if glacier_manager.IsChunkFile(info.Name()) {
+				// ダウンロード途中のチャンク
 			} else {
 				err = keepInGlacier(config, relPath, doRun)
 				if err != nil {
@@ -75,16 +109,29 @@ func keepInGlacier(config *util.Config, relPath string, doRun bool) error {
 	if err != nil {
 		return err
 	}
+	if ent != nil && ent.ArchiveId == "" {
+		// 前回のアップロードが完了していない
+		config.Logger.Printf("%v : Upload is not completed. Resume it.", relPath)
+		if !doRun {
+			config.Logger.Printf("DRY RUN: resume upload %v.", relPath)
+			return nil
+		}
+		be, err := config.Backend()
+		if err != nil {
+			return err
+		}
+		return cntmgr.ResumeToArchive(config.Logger, config.Database, be, config.DefaultDestination(), config.DocRoot, *ent, config.Key)
+	}
 	if ent != nil {
 		if ent.Lock == 0 {
 			config.Logger.Printf("%v: ファイルは存在しますがロックされていません", relPath)
 		}
-		return nil
+		return checkModified(config, *ent, doRun)
 	}
 
 	fullPath := filepath.Join(config.DocRoot, relPath)
 	// MD5でDBに当たってみる
-	md5sum, err := util.GetMD5(fullPath)
+	md5sum, sha256sum, err := util.GetSums(fullPath)
 	if err != nil {
 		return err
 	}
@@ -92,19 +139,26 @@ func keepInGlacier(config *util.Config, relPath string, doRun bool) error {
 	if err != nil {
 		return err
 	}
+	if ent != nil && ent.SHA256 != "" && ent.SHA256 != sha256sum {
+		// MD5だけが一致する別の内容
+		ent = nil
+	}
 	if ent != nil {
 		config.Logger.Printf("%v Exists same MD5 in DB.", relPath)
-		config.Logger.Printf("Rewrite path: %s -> %s", ent.Name, relPath)
-		if doRun {
-			err = model.UpdateName(config.Database, ent.Id, relPath)
-		}
-		return err
+		return addPath(config, *ent, relPath, doRun)
 	}
 	config.Logger.Printf("%v : Not exists so regist it.", relPath)
 
 	// 新規なので登録する
 	if doRun {
-		err = cntmgr.RegisterToArchive(config.Logger, config.Database, config.DocRoot, relPath, config.VaultName, config.Region, config.Key)
+		be, err := config.Backend()
+		if err != nil {
+			return err
+		}
+		err = cntmgr.RegisterToArchive(config.Logger, config.Database, be, config.DefaultDestination(), config.DocRoot, relPath, config.Key)
+		if err != nil {
+			return err
+		}
 	} else {
 		config.Logger.Printf("DRY RUN: upload %v to Glacier.", relPath)
 	}
@@ -112,8 +166,137 @@ func keepInGlacier(config *util.Config, relPath string, doRun bool) error {
 	return err
 }
 
+/*
+登録済みの内容と同じファイルを別のパスに見つけた
+
+同じ内容のパスのうち、ロックされているのに手元に無いものがあれば移動したものとしてパスを書き換える。
+無ければ同じアーカイブを指すパスを追加する。ロックは同じ内容の他のパスに合わせる
+*/
+func addPath(config *util.Config, ent model.FileEntry, relPath string, doRun bool) error {
+	fi, err := os.Stat(filepath.Join(config.DocRoot, relPath))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	paths, err := model.FindPaths(config.Database, ent.Id)
+	if err != nil {
+		return err
+	}
+
+	lock := 0
+	for _, p := range paths {
+		if p.Lock == 0 {
+			continue
+		}
+		lock = 1
+		_, err := os.Stat(filepath.Join(config.DocRoot, p.Name))
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		config.Logger.Printf("Rewrite path: %s -> %s", p.Name, relPath)
+		if !doRun {
+			return nil
+		}
+		err = model.UpdateName(config.Database, p.PathId, relPath)
+		if err != nil {
+			return err
+		}
+		return model.UpdateMtime(config.Database, p.PathId, fi.ModTime().UnixNano())
+	}
+
+	config.Logger.Printf("%v: %vと同じ内容のため、同じアーカイブ(ID %d)のパスとして登録します", relPath, ent.Name, ent.Id)
+	if !doRun {
+		return nil
+	}
+	return model.InsertPath(config.Database, ent.Id, relPath, fi.ModTime().UnixNano(), lock)
+}
+
+/*
+登録済みのファイルが変更されていたら新しい版として登録する
+
+サイズと更新日時が登録時と同じなら変更なしとみなす。違っていてもMD5が同じなら更新日時だけ記録し直す
+*/
+func checkModified(config *util.Config, ent model.FileEntry, doRun bool) error {
+	fullPath := filepath.Join(config.DocRoot, ent.Name)
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if fi.Size() == ent.Size && fi.ModTime().UnixNano() == ent.Mtime {
+		return nil
+	}
+
+	md5sum, err := util.GetMD5(fullPath)
+	if err != nil {
+		return err
+	}
+	if md5sum == ent.MD5Sum {
+		if !doRun {
+			return nil
+		}
+		return model.UpdateMtime(config.Database, ent.PathId, fi.ModTime().UnixNano())
+	}
+
+	config.Logger.Printf("%v : 登録時から変更されています。新しい版として登録します", ent.Name)
+	if !doRun {
+		config.Logger.Printf("DRY RUN: upload new version of %v to Glacier.", ent.Name)
+		return nil
+	}
+	be, err := config.Backend()
+	if err != nil {
+		return err
+	}
+	err = cntmgr.RegisterToArchive(config.Logger, config.Database, be, config.DefaultDestination(), config.DocRoot, ent.Name, config.Key)
+	if err != nil {
+		return err
+	}
+	return pruneVersions(config, ent.Name)
+}
+
+/*
+設定(old_versions)がdeleteなら、現在の版より前の版をアーカイブごと削除する
+*/
+func pruneVersions(config *util.Config, relPath string) error {
+	switch v := config.Value("old_versions", OLD_VERSIONS_KEEP); v {
+	case OLD_VERSIONS_KEEP:
+		return nil
+	case OLD_VERSIONS_DELETE:
+	default:
+		return errors.Errorf("old_versionsの値が不正です: %s(keepかdelete)", v)
+	}
+
+	cur, err := model.FindEntryByName(config.Database, relPath)
+	if err != nil || cur == nil {
+		return err
+	}
+	for id := cur.PrevId; id != 0; {
+		e, err := model.FindEntryById(config.Database, id)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			break
+		}
+		id = e.PrevId
+		if e.PathId != 0 {
+			// 同じ内容の別のパスではまだ現在の版。ここから前はそのパスの履歴でもあるので残す
+			break
+		}
+		config.Logger.Printf("%v: 古い版(ID %d)を削除します", e.Name, e.Id)
+		err = deleteArchives(config, *e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /*
 Lockフラグが付いているエントリについて、実在しているかを確認する
+
+同じ内容の別のパスのファイルが手元にあれば、取得せずにそこからコピーする
 */
 func checkDown(config *util.Config, doRun bool) error {
 
@@ -123,12 +306,30 @@ func checkDown(config *util.Config, doRun bool) error {
 	}
 
 	for _, e := range entry {
+		if config.Stopping() {
+			return ErrStopped
+		}
 		fullPath := filepath.Join(config.DocRoot, e.Name)
 
 		_, err := os.Stat(fullPath)
 		if err != nil {
 			if os.IsNotExist(err) {
+				if e.ArchiveId == "" {
+					// 登録したがアップロードが終わっていない版。前の版があればそのパスの行から取得する
+					config.Logger.Printf("%v: アップロードが完了していないため取得できません(ID %d)", e.Name, e.Id)
+					continue
+				}
+				copied, err := copyFromOtherPath(config, e, doRun)
+				if err != nil {
+					return err
+				}
+				if copied {
+					continue
+				}
 				err = processExtract(config, e, doRun)
+				if err != nil {
+					return err
+				}
 			} else {
 				return errors.WithStack(err)
 			}
@@ -164,23 +365,56 @@ func processExtract(config *util.Config, entry model.FileEntry, doRun bool) erro
 	return err
 }
 
+/*
+コストの小さいコピーから順に取得を試みる
+
+取得要求が不要な保存先ならその場でダウンロードし、ex_requestは作らない
+*/
 func requestExtractJob(config *util.Config, entry model.FileEntry) error {
 	fmt.Printf("%v is not exists. Request retrieve..\n", entry.Name)
 
-	gmgr, err := config.GlacierManager()
+	sources, err := retrievalSources(config, entry)
 	if err != nil {
 		return err
 	}
 
-	jobId, err := gmgr.RequestRetrieve(entry.ArchiveId)
-	if err != nil {
-		return err
+	for _, src := range sources {
+		be, err := config.BackendFor(src.dest)
+		if err != nil {
+			config.Logger.Printf("%v: 保存先%vが使用できません(%v)", entry.Name, src.dest.Name, err)
+			continue
+		}
+
+		if dd, ok := be.(backend.DirectDownloader); ok {
+			err = retrieveDirect(config, dd, entry, src)
+			if err != nil {
+				config.Logger.Printf("%v: %vからの取得に失敗しました(%v)", entry.Name, src.dest.Name, err)
+				continue
+			}
+			return nil
+		}
+
+		tier, err := retrievalTier(config, entry, be)
+		if err != nil {
+			return err
+		}
+		jobId, err := be.RequestRetrieve(src.archiveId, tier)
+		if err != nil {
+			config.Logger.Printf("%v: %vへの取得要求に失敗しました(%v)", entry.Name, src.dest.Name, err)
+			continue
+		}
+		config.Logger.Printf("%v: %vに取得要求を出しました(%v)", entry.Name, src.dest.Name, tier)
+		return model.InsertRequest(config.Database, entry.Id, jobId, src.dest.Name, tier)
 	}
-	return model.InsertRequest(config.Database, entry.Id, jobId)
+	return errors.Errorf("%v: 取得できるコピーがありません", entry.Name)
 }
 
 func retrieve(config *util.Config, ex model.ExRequest, entry model.FileEntry) error {
-	gmgr, err := config.GlacierManager()
+	dest, err := config.Destination(ex.Destination)
+	if err != nil {
+		return err
+	}
+	be, err := config.BackendFor(*dest)
 	if err != nil {
 		return err
 	}
@@ -189,18 +423,224 @@ func retrieve(config *util.Config, ex model.ExRequest, entry model.FileEntry) er
 	cryptFile := plainFile + ".enc"
 	defer os.Remove(cryptFile)
 
+	var treeHash string
+	rep, err := model.FindReplica(config.Database, entry.Id, ex.Destination)
+	if err != nil {
+		return err
+	}
+	if rep != nil {
+		treeHash = rep.TreeHash
+	}
+
+	// ジョブが取得するアーカイブがアップロードしたものか
+	if treeHash != "" {
+		job, err := be.DescribeJob(ex.JobId)
+		if err == nil && job.SHA256TreeHash != "" && job.SHA256TreeHash != treeHash {
+			config.Logger.Printf("%v: ツリーハッシュが一致しません。DB=%v <-> Job=%v", entry.Name, treeHash, job.SHA256TreeHash)
+			return ErrTreeHashMismatch
+		}
+	}
+
 	// DL
-	err = gmgr.DownloadFile(config.Logger, ex.JobId, cryptFile)
+	err = be.DownloadFile(config.Logger, ex.JobId, cryptFile)
 	if err != nil {
-		if err == glacier_manager.ErrJobNotComplete {
+		if err == backend.ErrJobNotComplete {
 			config.Logger.Printf("%v: 取得ジョブがまだ完了していません。もうしばらくしてから実行してください(開始時刻=%s)\n", entry.Name, ex.StartDt.Format("2006/01/02 15:04:05"))
 			return nil
+		} else if err == backend.ErrJobExpired {
+			// 取得要求を消して次回のsyncで出し直す
+			config.Logger.Printf("%v: 取得ジョブの期限が切れています。次回のsyncで取得要求を出し直します\n", entry.Name)
+			return model.DeleteRequest(config.Database, entry.Id)
 		} else {
 			return err
 		}
 	}
-	config.Logger.Printf("DL終了。復号中..")
+	config.Logger.Printf("DL終了。ツリーハッシュチェック")
+
+	err = verifyTreeHash(config, entry, cryptFile, treeHash)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("復号中..")
+
+	err = decryptEntry(config, entry, cryptFile, plainFile)
+	if err != nil {
+		return err
+	}
+
+	// ex_request削除
+	err = model.DeleteRequest(config.Database, entry.Id)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("復元完了")
+	return restoreOtherPaths(config, entry)
+}
+
+func retrieveDirect(config *util.Config, dd backend.DirectDownloader, entry model.FileEntry, src retrievalSource) error {
+	err := downloadDirect(config, dd, entry, src, filepath.Join(config.DocRoot, entry.Name))
+	if err != nil {
+		return err
+	}
+	return restoreOtherPaths(config, entry)
+}
+
+/*
+同じ内容の別のパスのファイルが手元にあればentryのパスにコピーする。コピーした(ドライランではコピーできる)場合true
+*/
+func copyFromOtherPath(config *util.Config, entry model.FileEntry, doRun bool) (bool, error) {
+	paths, err := model.FindPaths(config.Database, entry.Id)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range paths {
+		if p.PathId == entry.PathId {
+			continue
+		}
+		src := filepath.Join(config.DocRoot, p.Name)
+		_, err := os.Stat(src)
+		if err != nil {
+			continue
+		}
+
+		if !doRun {
+			config.Logger.Printf("DRY RUN: copy %s to %s", p.Name, entry.Name)
+			return true, nil
+		}
+		config.Logger.Printf("%v: 同じ内容の%vからコピーします", entry.Name, p.Name)
+		err = copyEntryFile(config, entry, src)
+		if errors.Cause(err) == ErrMD5Mismatch {
+			// コピー元が登録後に変更されている
+			config.Logger.Printf("%v: %vの内容が登録時と違うためコピーしません", entry.Name, p.Name)
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+/*
+srcをentryのパスにコピーしてMD5とタイムスタンプを確認・復元する
+*/
+func copyEntryFile(config *util.Config, entry model.FileEntry, src string) error {
+	plainFile := filepath.Join(config.DocRoot, entry.Name)
+	err := os.MkdirAll(filepath.Dir(plainFile), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+	out, err := os.Create(plainFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && fmt.Sprintf("%x", h.Sum(nil)) != entry.MD5Sum {
+		err = ErrMD5Mismatch
+	}
+	if err != nil {
+		os.Remove(plainFile)
+		return errors.WithStack(err)
+	}
+
+	t := time.Unix(0, entry.Mtime)
+	return errors.WithStack(os.Chtimes(plainFile, t, t))
+}
+
+/*
+復元したentryと同じ内容で、ロックされていて手元に無い他のパスにもコピーする
+*/
+func restoreOtherPaths(config *util.Config, entry model.FileEntry) error {
+	paths, err := model.FindPaths(config.Database, entry.Id)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if p.PathId == entry.PathId || p.Lock == 0 {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(config.DocRoot, p.Name))
+		if !os.IsNotExist(err) {
+			continue
+		}
+		_, err = copyFromOtherPath(config, p, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+取得要求の要らない保存先からダウンロードしてplainFileに復号する
+*/
+func downloadDirect(config *util.Config, dd backend.DirectDownloader, entry model.FileEntry, src retrievalSource, plainFile string) error {
+	cryptFile := plainFile + ".enc"
+	defer os.Remove(cryptFile)
+
+	err := dd.DownloadArchive(config.Logger, src.archiveId, cryptFile)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("DL終了。ツリーハッシュチェック")
+
+	err = verifyTreeHash(config, entry, cryptFile, src.treeHash)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("復号中..")
 
+	err = decryptEntry(config, entry, cryptFile, plainFile)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("復元完了")
+	return nil
+}
+
+/*
+ダウンロードしたアーカイブのツリーハッシュをアップロード時の記録と照合する
+
+記録が無い(ツリーハッシュを記録する前のアップロード)場合は照合しない
+*/
+func verifyTreeHash(config *util.Config, entry model.FileEntry, cryptFile, treeHash string) error {
+	if treeHash == "" {
+		return nil
+	}
+
+	f, err := os.Open(cryptFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	h, err := backend.TreeHash(f)
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", h) != treeHash {
+		config.Logger.Printf("%v: ツリーハッシュが一致しません。DB=%v <-> File=%x", entry.Name, treeHash, h)
+		return ErrTreeHashMismatch
+	}
+	return nil
+}
+
+/*
+ダウンロードしたファイルを復号してMD5とタイムスタンプを確認・復元する
+*/
+func decryptEntry(config *util.Config, entry model.FileEntry, cryptFile, plainFile string) error {
 	// 復号
 	iv, err := model.GetIV(config.Database, entry.Id)
 	if err != nil {
@@ -221,12 +661,5 @@ func retrieve(config *util.Config, ex model.ExRequest, entry model.FileEntry) er
 	//タイムスタンプ復元
 	t := time.Unix(0, entry.Mtime)
 	err = os.Chtimes(plainFile, t, t)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	// ex_request削除
-	err = model.DeleteRequest(config.Database, entry.Id)
-	config.Logger.Printf("復元完了")
-	return nil
+	return errors.WithStack(err)
 }
@@ -0,0 +1,170 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+	"time"
+)
+
+/*
+保存先に残っている未完了のアップロードと、それを再開する予定のエントリ
+*/
+type openUpload struct {
+	backend.MultipartUpload
+	entry *model.FileEntry
+}
+
+func multipartLister(config *util.Config, destName string) (*model.Destination, backend.MultipartLister, error) {
+	dest, err := config.Destination(destName)
+	if err != nil {
+		return nil, nil, err
+	}
+	be, err := config.BackendFor(*dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	ml, ok := be.(backend.MultipartLister)
+	if !ok {
+		return nil, nil, errors.Errorf("%v: 保存先が%sのため未完了のアップロードは扱えません", dest.Name, dest.Backend)
+	}
+	return dest, ml, nil
+}
+
+/*
+未完了のアップロードをカタログのアップロード状態と突き合わせる
+
+カタログに記録の無いものはentryがnil(孤立したアップロード)
+*/
+func openUploads(config *util.Config, dest model.Destination, ml backend.MultipartLister) ([]openUpload, error) {
+	uploads, err := ml.ListUploads()
+	if err != nil {
+		return nil, err
+	}
+	states, err := model.AllUploadStates(config.Database)
+	if err != nil {
+		return nil, err
+	}
+	byUploadId := map[string]int64{}
+	for _, st := range states {
+		if st.Destination == dest.Name && st.UploadId != "" {
+			byUploadId[st.UploadId] = st.Id
+		}
+	}
+
+	var result []openUpload
+	for _, u := range uploads {
+		ou := openUpload{MultipartUpload: u}
+		if id, ok := byUploadId[u.UploadId]; ok {
+			ou.entry, err = model.FindEntryById(config.Database, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, ou)
+	}
+	return result, nil
+}
+
+func UploadsList(config *util.Config, destName string) error {
+	dest, ml, err := multipartLister(config, destName)
+	if err != nil {
+		return err
+	}
+	uploads, err := openUploads(config, *dest, ml)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range uploads {
+		owner := "ORPHAN"
+		if u.entry != nil {
+			owner = fmt.Sprintf("%d:%s", u.entry.Id, u.entry.Name)
+		}
+		fmt.Printf("%s\t%s\t%d\t%s\n", u.UploadId, formatDate(u.CreationDate), u.PartSize, owner)
+	}
+	return nil
+}
+
+/*
+指定したアップロードを中止する
+
+カタログで再開待ちのものは、次回のsyncで最初からアップロードし直す
+*/
+func UploadsAbort(config *util.Config, destName string, uploadIds []string) error {
+	dest, ml, err := multipartLister(config, destName)
+	if err != nil {
+		return err
+	}
+	uploads, err := openUploads(config, *dest, ml)
+	if err != nil {
+		return err
+	}
+	byId := map[string]openUpload{}
+	for _, u := range uploads {
+		byId[u.UploadId] = u
+	}
+
+	for _, uploadId := range uploadIds {
+		u, ok := byId[uploadId]
+		if !ok {
+			config.Logger.Printf("%v: 未完了のアップロードが見つかりません", uploadId)
+			continue
+		}
+		err = abortUpload(config, ml, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+カタログに記録の無い、olderThanより古いアップロードを中止する
+*/
+func UploadsGc(config *util.Config, destName string, olderThan time.Duration, doRun bool) error {
+	dest, ml, err := multipartLister(config, destName)
+	if err != nil {
+		return err
+	}
+	uploads, err := openUploads(config, *dest, ml)
+	if err != nil {
+		return err
+	}
+
+	limit := time.Now().Add(-olderThan)
+	n := 0
+	for _, u := range uploads {
+		if u.entry != nil || u.CreationDate.After(limit) {
+			continue
+		}
+		n++
+		if !doRun {
+			config.Logger.Printf("DRY RUN: abort %v (開始時刻=%s)", u.UploadId, formatDate(u.CreationDate))
+			continue
+		}
+		err = abortUpload(config, ml, u)
+		if err != nil {
+			return err
+		}
+	}
+	config.Logger.Printf("%v: 孤立したアップロード %d件", dest.Name, n)
+	return nil
+}
+
+func abortUpload(config *util.Config, ml backend.MultipartLister, u openUpload) error {
+	err := ml.AbortUpload(u.UploadId)
+	if err != nil {
+		return err
+	}
+	if u.entry != nil {
+		err = model.UpdateUploadId(config.Database, u.entry.Id, "", 0)
+		if err != nil {
+			return err
+		}
+	}
+	config.Logger.Printf("アップロードを中止しました: %v", u.UploadId)
+	return nil
+}
@@ -0,0 +1,78 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/glacier-manager"
+	"github.com/rami1942/glaman/util"
+	"time"
+)
+
+func vaultManager(config *util.Config) (*glacier_manager.Manager, error) {
+	if config.BackendType != util.BACKEND_GLACIER {
+		return nil, errors.Errorf("保存先が%sのためvaultの操作はできません", config.BackendType)
+	}
+	return config.GlacierManager()
+}
+
+func VaultCreate(config *util.Config, name string) error {
+	gmgr, err := vaultManager(config)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = config.VaultName
+	}
+
+	err = gmgr.CreateVault(name)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("vault %s を作成しました", name)
+	return nil
+}
+
+func VaultList(config *util.Config) error {
+	gmgr, err := vaultManager(config)
+	if err != nil {
+		return err
+	}
+
+	vaults, err := gmgr.ListVaults()
+	if err != nil {
+		return err
+	}
+	for _, v := range vaults {
+		fmt.Printf("%s\t%d\t%d\t%s\n", v.Name, v.NumberOfArchives, v.SizeInBytes, formatDate(v.CreationDate))
+	}
+	return nil
+}
+
+func VaultDescribe(config *util.Config, name string) error {
+	gmgr, err := vaultManager(config)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = config.VaultName
+	}
+
+	v, err := gmgr.DescribeVault(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("名前:\t%s\n", v.Name)
+	fmt.Printf("リージョン:\t%s\n", gmgr.Region)
+	fmt.Printf("作成日時:\t%s\n", formatDate(v.CreationDate))
+	fmt.Printf("アーカイブ数:\t%d\n", v.NumberOfArchives)
+	fmt.Printf("サイズ:\t%d\n", v.SizeInBytes)
+	fmt.Printf("最終インベントリ日時:\t%s\n", formatDate(v.LastInventoryDate))
+	return nil
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006/01/02 15:04:05")
+}
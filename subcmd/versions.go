@@ -0,0 +1,227 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+パスの全ての版を古い順に表示する。版番号は1から
+*/
+func Versions(config *util.Config, relPath string) error {
+	versions, err := model.FindVersions(config.Database, relPath)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return errors.Errorf("%s: 登録されていません", relPath)
+	}
+
+	for i, e := range versions {
+		t := time.Unix(0, e.Mtime)
+		status := "現在"
+		if e.ArchiveId == "" {
+			status = "未完了"
+		} else if e.ReplacedDt != 0 {
+			status = "置換 " + time.Unix(0, e.ReplacedDt).Format("2006/01/02 15:04:05")
+		}
+		fmt.Printf("%d\t%d\t%s\t%d\t%s\t%s\t%s\n", i+1, e.Id, t.Format("2006/01/02 15:04:05"), e.Size, e.MD5Sum, e.Name, status)
+	}
+	return nil
+}
+
+/*
+指定した版を取得してoutに復号する
+
+versionは版番号(1から)、atは日時で、その時点の版(更新日時がat以前で最新の版)を選ぶ。どちらも無ければ最新の版。
+取得要求が必要な保存先では1回目の実行で要求を出し、ジョブの完了後にもう一度実行するとダウンロードする。
+outを省略した場合はカレントディレクトリの"<ファイル名>.v<版番号>"
+*/
+func Restore(config *util.Config, relPath string, version int, at, out, tier string) error {
+	versions, err := model.FindVersions(config.Database, relPath)
+	if err != nil {
+		return err
+	}
+	n, err := selectVersion(versions, version, at)
+	if err != nil {
+		return errors.WithMessage(err, relPath)
+	}
+	entry := versions[n-1]
+	if entry.ArchiveId == "" {
+		return errors.Errorf("%s: 版%dはアップロードが完了していません", relPath, n)
+	}
+
+	if out == "" {
+		out = fmt.Sprintf("%s.v%d", filepath.Base(entry.Name), n)
+	}
+	// 保存先はダウンロード先のディレクトリを作るので絶対パスにしておく
+	out, err = filepath.Abs(out)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	config.Logger.Printf("%v: 版%d(ID %d, %s)を%sに復元します", entry.Name, n, entry.Id,
+		time.Unix(0, entry.Mtime).Format("2006/01/02 15:04:05"), out)
+
+	req, err := model.FindRestoreRequest(config.Database, entry.Id, out)
+	if err != nil {
+		return err
+	}
+	if req == nil {
+		req, err = requestRestore(config, entry, out, tier)
+		if err != nil || req == nil {
+			return err
+		}
+	}
+
+	dest, err := config.Destination(req.Destination)
+	if err != nil {
+		return err
+	}
+	be, err := config.BackendFor(*dest)
+	if err != nil {
+		return err
+	}
+
+	cryptFile := out + ".enc"
+	defer os.Remove(cryptFile)
+
+	err = be.DownloadFile(config.Logger, req.JobId, cryptFile)
+	if err == backend.ErrJobNotComplete {
+		config.Logger.Printf("%v: 取得ジョブがまだ完了していません。もうしばらくしてから実行してください(開始時刻=%s)",
+			entry.Name, req.StartDt.Format("2006/01/02 15:04:05"))
+		return nil
+	} else if err == backend.ErrJobExpired {
+		config.Logger.Printf("%v: 取得ジョブの期限が切れています。もう一度実行すると取得要求を出し直します", entry.Name)
+		return model.DeleteRestoreRequest(config.Database, req.Id)
+	} else if err != nil {
+		return err
+	}
+	config.Logger.Printf("DL終了。ツリーハッシュチェック")
+
+	rep, err := model.FindReplica(config.Database, entry.Id, req.Destination)
+	if err != nil {
+		return err
+	}
+	var treeHash string
+	if rep != nil {
+		treeHash = rep.TreeHash
+	}
+	err = verifyTreeHash(config, entry, cryptFile, treeHash)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("復号中..")
+
+	err = decryptEntry(config, entry, cryptFile, out)
+	if err != nil {
+		return err
+	}
+	config.Logger.Printf("復元完了")
+	return model.DeleteRestoreRequest(config.Database, req.Id)
+}
+
+/*
+取得元を選んで取得要求を出す。取得要求の要らない保存先ならその場で復元してnilを返す
+*/
+func requestRestore(config *util.Config, entry model.FileEntry, out, tier string) (*model.RestoreRequest, error) {
+	tier, err := tierOrDefault(config, tier)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := retrievalSources(config, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, src := range sources {
+		be, err := config.BackendFor(src.dest)
+		if err != nil {
+			config.Logger.Printf("%v: 保存先%vが使用できません(%v)", entry.Name, src.dest.Name, err)
+			continue
+		}
+
+		if dd, ok := be.(backend.DirectDownloader); ok {
+			err = downloadDirect(config, dd, entry, src, out)
+			if err != nil {
+				config.Logger.Printf("%v: %vからの取得に失敗しました(%v)", entry.Name, src.dest.Name, err)
+				continue
+			}
+			return nil, nil
+		}
+
+		jobId, err := be.RequestRetrieve(src.archiveId, tier)
+		if err != nil {
+			config.Logger.Printf("%v: %vへの取得要求に失敗しました(%v)", entry.Name, src.dest.Name, err)
+			continue
+		}
+		config.Logger.Printf("%v: %vに取得要求を出しました(%v)", entry.Name, src.dest.Name, tier)
+		err = model.InsertRestoreRequest(config.Database, entry.Id, out, jobId, src.dest.Name)
+		if err != nil {
+			return nil, err
+		}
+		return model.FindRestoreRequest(config.Database, entry.Id, out)
+	}
+	return nil, errors.Errorf("%v: 取得できるコピーがありません", entry.Name)
+}
+
+/*
+取得する版の番号(1から)を選ぶ
+*/
+func selectVersion(versions []model.FileEntry, version int, at string) (int, error) {
+	if len(versions) == 0 {
+		return 0, errors.New("登録されていません")
+	}
+	if version != 0 {
+		if version < 1 || version > len(versions) {
+			return 0, errors.Errorf("版%dはありません(1〜%d)", version, len(versions))
+		}
+		return version, nil
+	}
+
+	if at == "" {
+		// アップロードが完了している最新の版
+		for n := len(versions); n >= 1; n-- {
+			if versions[n-1].ArchiveId != "" {
+				return n, nil
+			}
+		}
+		return 0, errors.New("アップロードが完了した版がありません")
+	}
+
+	t, err := parseAt(at, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for n := len(versions); n >= 1; n-- {
+		if versions[n-1].ArchiveId != "" && versions[n-1].Mtime <= t.UnixNano() {
+			return n, nil
+		}
+	}
+	return 0, errors.Errorf("%s以前の版はありません", t.Format("2006/01/02 15:04"))
+}
+
+/*
+--atの解釈。"6h"のような時間は現在からその時間だけ前、それ以外は"2006/01/02 15:04"形式の日時
+*/
+func parseAt(s string, now time.Time) (time.Time, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		if d < 0 {
+			return time.Time{}, errors.Errorf("時間は正の値で指定してください: %s", s)
+		}
+		return now.Add(-d), nil
+	}
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("日時の形式が不正です: %s", s)
+}
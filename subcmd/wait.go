@@ -0,0 +1,200 @@
+package subcmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+発行済みの取得要求のジョブをinterval毎に確認し、完了したものから順にダウンロード・復号する
+
+全て完了するか、timeout(0なら無制限)を過ぎたら終了する。期限切れのジョブは取得要求を出し直して待ち続ける
+*/
+func Wait(config *util.Config, interval, timeout time.Duration) error {
+	requests, err := model.AllRequests(config.Database)
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		config.Logger.Printf("完了待ちの取得要求はありません")
+		return nil
+	}
+
+	var pending []int64
+	for _, ex := range requests {
+		pending = append(pending, ex.Id)
+	}
+
+	start := time.Now()
+	failed := 0
+	for {
+		var next []int64
+		var last time.Time
+		for _, id := range pending {
+			done, eta, err := pollRequest(config, id)
+			if cause := errors.Cause(err); cause == ErrMD5Mismatch || cause == ErrTreeHashMismatch {
+				// やり直しても直らないので待つのをやめる
+				config.Logger.Printf("%+v", err)
+				failed++
+				continue
+			} else if err != nil {
+				// 通信エラー等は次回の確認でやり直す
+				config.Logger.Printf("%+v", err)
+			} else if done {
+				continue
+			}
+			next = append(next, id)
+			if eta.After(last) {
+				last = eta
+			}
+		}
+		pending = next
+
+		if len(pending) == 0 && failed > 0 {
+			return errors.Errorf("%d件の取得に失敗しました", failed)
+		}
+		if len(pending) == 0 {
+			config.Logger.Printf("全ての取得が完了しました(%d件, %v)", len(requests), time.Since(start).Round(time.Second))
+			return nil
+		}
+		if timeout > 0 && time.Since(start)+interval > timeout {
+			return errors.Errorf("タイムアウトしました。未完了の取得要求が%d件あります", len(pending))
+		}
+		if last.IsZero() {
+			config.Logger.Printf("未完了: %d/%d件。%v後に確認します", len(pending), len(requests), interval)
+		} else {
+			config.Logger.Printf("未完了: %d/%d件。全体の完了予定 %s。%v後に確認します",
+				len(pending), len(requests), last.Local().Format("2006/01/02 15:04"), interval)
+		}
+		time.Sleep(interval)
+	}
+}
+
+/*
+1件の取得要求の状態を確認し、ジョブが完了していれば取得する
+
+取得が済んだ(または不要になった)場合にtrue、未完了ならジョブの完了予定時刻(不明ならゼロ値)を返す
+*/
+func pollRequest(config *util.Config, id int64) (bool, time.Time, error) {
+	entry, err := model.FindEntryById(config.Database, id)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if entry == nil {
+		return true, time.Time{}, model.DeleteRequest(config.Database, id)
+	}
+	entry, err = pathToRetrieve(config, id)
+	if err != nil || entry == nil {
+		return entry == nil, time.Time{}, err
+	}
+
+	ex, err := model.FindExRequestById(config.Database, id)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if ex == nil {
+		// ジョブの期限切れ等で取得要求が消えたので出し直す
+		return false, time.Time{}, requestExtractJob(config, *entry)
+	}
+
+	dest, err := config.Destination(ex.Destination)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	be, err := config.BackendFor(*dest)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	job, err := be.DescribeJob(ex.JobId)
+	if err == nil && !job.Completed {
+		return false, printProgress(config, *entry, *ex, job, be), nil
+	}
+
+	// 完了しているか、期限切れ等で状態が取れない場合はretrieveに任せる
+	err = retrieve(config, *ex, *entry)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	entry, err = pathToRetrieve(config, id)
+	return entry == nil, time.Time{}, err
+}
+
+/*
+ジョブの経過時間と、ジョブの作成日時とティアから見積もった完了予定時刻を表示する
+*/
+func printProgress(config *util.Config, entry model.FileEntry, ex model.ExRequest, job *backend.Job, be backend.Backend) time.Time {
+	created := job.CreationDate
+	if created.IsZero() {
+		created = ex.StartDt
+	}
+	elapsed := formatMinutes(time.Since(created))
+
+	tier := job.Tier
+	if tier == "" {
+		tier = ex.Tier
+	}
+	te, ok := be.(backend.TierEstimator)
+	if !ok {
+		config.Logger.Printf("%v: 待機中(経過 %s)", entry.Name, elapsed)
+		return time.Time{}
+	}
+	d, ok := te.TierDurations()[tier]
+	if !ok {
+		config.Logger.Printf("%v: 待機中(経過 %s)", entry.Name, elapsed)
+		return time.Time{}
+	}
+
+	eta := created.Add(d)
+	left := time.Until(eta)
+	if left <= 0 {
+		config.Logger.Printf("%v: 待機中(経過 %s, %s)。完了予定 %sを過ぎています",
+			entry.Name, elapsed, tier, eta.Local().Format("2006/01/02 15:04"))
+	} else {
+		config.Logger.Printf("%v: 待機中(経過 %s, %s)。完了予定 %s(あと %s)",
+			entry.Name, elapsed, tier, eta.Local().Format("2006/01/02 15:04"), formatMinutes(left))
+	}
+	return eta
+}
+
+/*
+分単位の時間の表示("5h0m"等)
+*/
+func formatMinutes(d time.Duration) string {
+	if d < time.Minute {
+		return "1分未満"
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
+
+/*
+syncと同じく、ロックされていて手元に無いものだけを取得する
+
+取得先にするパス(同じ内容のパスが複数あれば最初のもの)を返す。取得の必要が無ければnil
+*/
+func pathToRetrieve(config *util.Config, id int64) (*model.FileEntry, error) {
+	paths, err := model.FindPaths(config.Database, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if p.Lock == 0 {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(config.DocRoot, p.Name))
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+		return &p, nil
+	}
+	return nil, nil
+}
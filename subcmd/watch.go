@@ -0,0 +1,189 @@
+package subcmd
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/rami1942/glaman/glacier-manager"
+	"github.com/rami1942/glaman/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// アップロード待ちのファイルの上限
+const watchQueueSize = 1024
+
+/*
+書き込み中のファイルの最後に見た状態
+*/
+type settling struct {
+	size    int64
+	mtime   time.Time
+	changed time.Time
+}
+
+/*
+同期対象ディレクトリを監視し、新しいファイルをアップロードする
+
+ファイルはサイズと更新日時がquietの間変わらなくなってから登録する。移動したファイルは
+syncと同じくMD5でカタログのエントリを見つけてパスを書き換えるので、アップロードし直さない
+*/
+func Watch(config *util.Config, quiet time.Duration, doRun bool) error {
+	if !doRun {
+		config.Logger.Printf("ドライランモードのため、実際のアップロードは行われません。行うには-rオプションをつけてください。")
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer w.Close()
+	defer stopOnSignal(config)()
+
+	err = addWatches(w, config.DocRoot)
+	if err != nil {
+		return err
+	}
+
+	// 空文字列はディレクトリ全体の走査
+	queue := make(chan string, watchQueueSize)
+	done := make(chan error, 1)
+	go func() {
+		done <- watchWorker(config, queue, doRun)
+	}()
+	// 監視を始める前に増えたファイル
+	queue <- ""
+
+	pending := map[string]*settling{}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	config.Logger.Printf("%sを監視しています(待ち時間=%v)", config.DocRoot, quiet)
+	for {
+		select {
+		case <-config.Stop:
+			close(queue)
+			return <-done
+		case err := <-done:
+			return err
+		case ev := <-w.Events:
+			onWatchEvent(config, w, pending, ev)
+		case err := <-w.Errors:
+			if err == fsnotify.ErrEventOverflow {
+				// 取りこぼしたイベントがあるので全体を走査し直す
+				config.Logger.Printf("ファイルの変更が多すぎて追いきれませんでした。全体を走査します")
+				queue <- ""
+			} else {
+				config.Logger.Printf("%+v", errors.WithStack(err))
+			}
+		case now := <-ticker.C:
+			for rel, s := range pending {
+				fi, err := os.Stat(filepath.Join(config.DocRoot, rel))
+				if err != nil {
+					delete(pending, rel)
+					continue
+				}
+				if fi.Size() != s.size || !fi.ModTime().Equal(s.mtime) {
+					s.size, s.mtime, s.changed = fi.Size(), fi.ModTime(), now
+					continue
+				}
+				if now.Sub(s.changed) >= quiet {
+					delete(pending, rel)
+					queue <- rel
+				}
+			}
+		}
+	}
+}
+
+func onWatchEvent(config *util.Config, w *fsnotify.Watcher, pending map[string]*settling, ev fsnotify.Event) {
+	rel, err := filepath.Rel(config.DocRoot, ev.Name)
+	if err != nil {
+		return
+	}
+
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// 移動元。移動先はCreateで届く
+		delete(pending, rel)
+		for p := range pending {
+			if strings.HasPrefix(p, rel+string(filepath.Separator)) {
+				delete(pending, p)
+			}
+		}
+		w.Remove(ev.Name)
+		return
+	}
+
+	fi, err := os.Lstat(ev.Name)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() {
+		if ev.Op&fsnotify.Create == 0 {
+			return
+		}
+		// 作られたか移動してきたディレクトリ。監視を始める前に中にできたファイルも拾う
+		err = addWatches(w, ev.Name)
+		if err != nil {
+			config.Logger.Printf("%+v", err)
+		}
+		filepath.Walk(ev.Name, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				r, err := filepath.Rel(config.DocRoot, path)
+				if err == nil {
+					markChanged(pending, r, info)
+				}
+			}
+			return nil
+		})
+		return
+	}
+	if !fi.Mode().IsRegular() || glacier_manager.IsChunkFile(fi.Name()) {
+		return
+	}
+	markChanged(pending, rel, fi)
+}
+
+func markChanged(pending map[string]*settling, rel string, fi os.FileInfo) {
+	pending[rel] = &settling{fi.Size(), fi.ModTime(), time.Now()}
+}
+
+/*
+dir以下の全てのディレクトリを監視対象にする
+*/
+func addWatches(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if info.IsDir() {
+			return errors.WithStack(w.Add(path))
+		}
+		return nil
+	})
+}
+
+/*
+落ち着いたファイルを順に登録する。停止要求を受けたら処理中のファイルが終わったところで戻る
+*/
+func watchWorker(config *util.Config, queue <-chan string, doRun bool) error {
+	for rel := range queue {
+		if config.Stopping() {
+			return nil
+		}
+
+		var err error
+		if rel == "" {
+			err = checkUpl(config, doRun)
+		} else if _, serr := os.Stat(filepath.Join(config.DocRoot, rel)); serr == nil {
+			err = keepInGlacier(config, rel, doRun)
+		}
+		if errors.Cause(err) == ErrStopped {
+			return nil
+		} else if err != nil {
+			config.Logger.Printf("%+v", err)
+		}
+	}
+	return nil
+}
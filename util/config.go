@@ -5,7 +5,16 @@ import (
 	"database/sql"
 	"github.com/pkg/errors"
 	"log"
+	"github.com/rami1942/glaman/backend"
+	"github.com/rami1942/glaman/gcs-manager"
 	"github.com/rami1942/glaman/glacier-manager"
+	"github.com/rami1942/glaman/local-manager"
+	"github.com/rami1942/glaman/model"
+	"github.com/rami1942/glaman/s3-manager"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -18,7 +27,16 @@ type Config struct {
 	Key    []byte
 	Logger *log.Logger
 
+	// 保存先の種類(省略時はglacier)
+	BackendType string
+
+	// 閉じると処理中のファイルが終わったところで止める(daemonの終了用)。nilなら止めない
+	Stop chan struct{}
+
 	glacierManager *glacier_manager.Manager
+	backends       map[string]backend.Backend
+
+	values map[string]string
 }
 
 const (
@@ -26,9 +44,32 @@ const (
 	cfg_VAULT    = "vault"
 	cfg_PASSWORD = "password"
 	cfg_DOCROOT  = "basedir"
+	cfg_BACKEND  = "backend"
+
+	cfg_LOCAL_DIR   = "localdir"
+	cfg_LOCAL_DELAY = "localdelay"
+
+	cfg_STORAGE_CLASS = "storageclass"
+	cfg_ENDPOINT      = "endpoint"
+	cfg_RESTORE_DAYS  = "restoredays"
+
+	cfg_COST     = "cost"
+	cfg_REPLICAS = "replicas"
+
+	cfg_SNS_TOPIC = "sns_topic"
+
+	BACKEND_GLACIER = "glacier"
+	BACKEND_LOCAL   = "local"
+	BACKEND_S3      = "s3"
+	BACKEND_GCS     = "gcs"
 )
 
 func NewConfig(logger *log.Logger, db *sql.DB) (*Config, error) {
+	err := model.Migrate(db)
+	if err != nil {
+		return nil, err
+	}
+
 	// 設定の取得
 	rows, err := db.Query("select k, v from config")
 	if err != nil {
@@ -57,7 +98,64 @@ func NewConfig(logger *log.Logger, db *sql.DB) (*Config, error) {
 	if err != nil {
 		return nil, errors.Cause(err)
 	}
-	return &Config{db, cfgMap[cfg_REGION], cfgMap[cfg_VAULT], cfgMap[cfg_DOCROOT], k, logger, nil}, nil
+	backendType, ok := cfgMap[cfg_BACKEND]
+	if !ok {
+		backendType = BACKEND_GLACIER
+	}
+
+	return &Config{
+		Database:    db,
+		Region:      cfgMap[cfg_REGION],
+		VaultName:   cfgMap[cfg_VAULT],
+		DocRoot:     cfgMap[cfg_DOCROOT],
+		Key:         k,
+		Logger:      logger,
+		BackendType: backendType,
+		backends:    map[string]backend.Backend{},
+		values:      cfgMap,
+	}, nil
+}
+
+/*
+configテーブルの値を返す。未設定ならdefを返す
+*/
+func (c *Config) Value(k, def string) string {
+	v, ok := c.values[k]
+	if !ok {
+		return def
+	}
+	return v
+}
+
+/*
+停止が要求されているか
+*/
+func (c *Config) Stopping() bool {
+	select {
+	case <-c.Stop:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+configテーブルに値を設定する
+*/
+func (c *Config) SetValue(k, v string) error {
+	_, err := c.Database.Exec("insert or replace into config (k, v) values (?, ?)", k, v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c.values[k] = v
+	return nil
+}
+
+/*
+configテーブルの値を全て返す
+*/
+func (c *Config) Values() map[string]string {
+	return c.values
 }
 
 func getKey(logger *log.Logger, plain string) ([]byte, error) {
@@ -76,5 +174,202 @@ func (c *Config) GlacierManager() (*glacier_manager.Manager, error) {
 	if c.glacierManager != nil {
 		return c.glacierManager, nil
 	}
-	return glacier_manager.New("-", c.VaultName, c.Region)
+	gmgr, err := glacier_manager.NewWithEndpoint("-", c.VaultName, c.Region, c.Value(cfg_ENDPOINT, ""))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	gmgr.SNSTopic = c.snsTopicFor(c.Region)
+	c.glacierManager = gmgr
+	return gmgr, nil
+}
+
+/*
+ジョブの完了を通知するSNSトピックのARN。未設定なら空
+*/
+func (c *Config) SNSTopic() string {
+	return c.Value(cfg_SNS_TOPIC, "")
+}
+
+/*
+regionのvaultで使えるSNSトピック
+
+SNSトピックはvaultと同じリージョンでないと指定できないので、違う場合は空を返す
+*/
+func (c *Config) snsTopicFor(region string) string {
+	topic := c.SNSTopic()
+	// arn:aws:sns:<region>:<account>:<name>
+	f := strings.Split(topic, ":")
+	if len(f) < 6 || f[3] != region {
+		return ""
+	}
+	return topic
+}
+
+/*
+configテーブルの設定で表される既定の保存先
+*/
+func (c *Config) DefaultDestination() model.Destination {
+	cost := DefaultCost(c.BackendType)
+	if v := c.Value(cfg_COST, ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil {
+			cost = n
+		}
+	}
+	return model.Destination{
+		Name:         model.DEFAULT_DESTINATION,
+		Backend:      c.BackendType,
+		Region:       c.Region,
+		Vault:        c.VaultName,
+		LocalDir:     c.Value(cfg_LOCAL_DIR, ""),
+		LocalDelay:   c.Value(cfg_LOCAL_DELAY, ""),
+		StorageClass: c.Value(cfg_STORAGE_CLASS, ""),
+		Endpoint:     c.Value(cfg_ENDPOINT, ""),
+		Cost:         cost,
+	}
+}
+
+/*
+既定の保存先とdestinationテーブルの保存先をコストの小さい順に返す
+*/
+func (c *Config) Destinations() ([]model.Destination, error) {
+	dests, err := model.AllDestinations(c.Database)
+	if err != nil {
+		return nil, err
+	}
+	dests = append([]model.Destination{c.DefaultDestination()}, dests...)
+	sort.SliceStable(dests, func(i, j int) bool {
+		return dests[i].Cost < dests[j].Cost
+	})
+	return dests, nil
+}
+
+/*
+名前から保存先を取得する
+*/
+func (c *Config) Destination(name string) (*model.Destination, error) {
+	if name == model.DEFAULT_DESTINATION {
+		d := c.DefaultDestination()
+		return &d, nil
+	}
+	d, err := model.FindDestinationByName(c.Database, name)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, errors.Errorf("保存先%sが登録されていません", name)
+	}
+	return d, nil
+}
+
+/*
+保存先の種類ごとの既定のコスト。小さいほど取得時に優先する
+*/
+func DefaultCost(backendType string) int {
+	switch backendType {
+	case BACKEND_LOCAL:
+		return 10
+	case BACKEND_GCS:
+		return 20
+	case BACKEND_S3:
+		return 30
+	default:
+		return 40
+	}
+}
+
+/*
+設定された既定の保存先を返す
+*/
+func (c *Config) Backend() (backend.Backend, error) {
+	return c.BackendFor(c.DefaultDestination())
+}
+
+/*
+保存先に対応するバックエンドを返す
+*/
+func (c *Config) BackendFor(d model.Destination) (backend.Backend, error) {
+	if be, ok := c.backends[d.Name]; ok {
+		return be, nil
+	}
+
+	var be backend.Backend
+	switch d.Backend {
+	case BACKEND_GLACIER:
+		if d.Name == model.DEFAULT_DESTINATION {
+			gmgr, err := c.GlacierManager()
+			if err != nil {
+				return nil, err
+			}
+			be = gmgr
+		} else {
+			gmgr, err := glacier_manager.NewWithEndpoint("-", d.Vault, d.Region, d.Endpoint)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			gmgr.SNSTopic = c.snsTopicFor(d.Region)
+			be = gmgr
+		}
+	case BACKEND_LOCAL:
+		if d.LocalDir == "" {
+			return nil, errors.Errorf("%s: %sが設定されていません", d.Name, cfg_LOCAL_DIR)
+		}
+		delay := time.Duration(0)
+		if d.LocalDelay != "" {
+			var err error
+			delay, err = time.ParseDuration(d.LocalDelay)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: %sの形式が不正です", d.Name, cfg_LOCAL_DELAY)
+			}
+		}
+		lmgr, err := local_manager.New(d.LocalDir, delay)
+		if err != nil {
+			return nil, err
+		}
+		be = lmgr
+	case BACKEND_S3:
+		// S3の場合vaultはバケット名
+		sc := d.StorageClass
+		if sc == "" {
+			sc = s3_manager.STORAGE_CLASS_DEEP_ARCHIVE
+		}
+		smgr, err := s3_manager.New(d.Vault, d.Region, sc, d.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if v := c.Value(cfg_RESTORE_DAYS, ""); v != "" {
+			days, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%sの形式が不正です", cfg_RESTORE_DAYS)
+			}
+			smgr.RestoreDays = days
+		}
+		be = smgr
+	case BACKEND_GCS:
+		// GCSの場合vaultはバケット名
+		sc := d.StorageClass
+		if sc == "" {
+			sc = gcs_manager.STORAGE_CLASS_COLDLINE
+		}
+		gcsmgr, err := gcs_manager.New(d.Vault, sc, d.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		be = gcsmgr
+	default:
+		return nil, errors.Errorf("未対応の保存先です: %s", d.Backend)
+	}
+	c.backends[d.Name] = be
+	return be, nil
+}
+
+/*
+必要なコピー数
+*/
+func (c *Config) Replicas() int {
+	n, err := strconv.Atoi(c.Value(cfg_REPLICAS, "1"))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
 }
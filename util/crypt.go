@@ -68,48 +68,120 @@ func Decrypt(cryptedFile, plainFile string, key []byte, iv []byte) (plainMd5sum
 	return
 }
 
-func Encrypt(plainFile, cryptedFile string, key []byte, iv []byte) (plainMd5sum []byte, err error) {
-	inFile, err := os.Open(plainFile)
+/*
+アーカイブのoffバイト目から始まる部分を復号し、先頭skipバイトを除いたnバイトをplainFileに書き出す
+
+AES-CTRなのでoffに対応するキーストリームを求めれば部分だけで復号できる
+*/
+func DecryptRange(cryptedFile, plainFile string, key []byte, iv []byte, off, skip, n int64) error {
+	inFile, err := os.Open(cryptedFile)
 	if err != nil {
-		return
+		return errors.WithStack(err)
 	}
 	defer inFile.Close()
 
-	hash := md5.New()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-	outFile, err := os.Create(cryptedFile)
+	outFile, err := os.Create(plainFile)
 	if err != nil {
-		return
+		return errors.WithStack(err)
 	}
 	defer outFile.Close()
 
+	stream := CTRStreamAt(block, iv, off+skip)
+	reader := &cipher.StreamReader{S: stream, R: io.NewSectionReader(inFile, skip, n)}
+
+	w, err := io.Copy(outFile, reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if w != n {
+		return errors.Errorf("%s: 取得したデータが範囲より短いです(%d < %d)", cryptedFile, w, n)
+	}
+	return nil
+}
+
+/*
+平文ファイルを暗号化しながら読むio.ReaderAt
+
+AES-CTRなので任意の位置から暗号化できる。暗号文を一時ファイルに書き出さずにアップロードするために使う
+*/
+type EncryptedFile struct {
+	f     *os.File
+	block cipher.Block
+	iv    []byte
+	size  int64
+}
+
+/*
+サイズは開いた時点のもの。それ以降に追記された分は読まない
+*/
+func OpenEncrypted(plainFile string, key []byte, iv []byte) (*EncryptedFile, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return
+		return nil, errors.WithStack(err)
 	}
-	stream := cipher.NewCTR(block, iv)
-	writer := &cipher.StreamWriter{S: stream, W: outFile}
+	f, err := os.Open(plainFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &EncryptedFile{f, block, iv, fi.Size()}, nil
+}
 
-	buf := make([]byte, bufsize)
-	for {
-		n, err := inFile.Read(buf)
-		if n == 0 {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+func (e *EncryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= e.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.size-off {
+		p = p[:e.size-off]
+	}
+	n, err := e.f.ReadAt(p, off)
+	if n > 0 {
+		CTRStreamAt(e.block, e.iv, off).XORKeyStream(p[:n], p[:n])
+	}
+	if err == nil && off+int64(n) == e.size {
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF {
+		// io.EOFは呼び出し側が比較するのでラップしない
+		err = errors.WithStack(err)
+	}
+	return n, err
+}
 
-		_, err = hash.Write(buf[:n])
-		if err != nil {
-			return nil, err
-		}
+func (e *EncryptedFile) Size() int64 {
+	return e.size
+}
 
-		_, err = writer.Write(buf[:n])
-		if err != nil {
-			return nil, err
-		}
+func (e *EncryptedFile) Close() error {
+	return errors.WithStack(e.f.Close())
+}
+
+/*
+先頭からoffバイト目の位置から始まるCTRのキーストリーム
+*/
+func CTRStreamAt(block cipher.Block, iv []byte, off int64) cipher.Stream {
+	// カウンタ(IVを128bitのビッグエンディアン整数とみなす)にブロック数を足す
+	ctr := make([]byte, len(iv))
+	copy(ctr, iv)
+	carry := uint64(off / aes.BlockSize)
+	for i := len(ctr) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(ctr[i]) + carry&0xff
+		ctr[i] = byte(sum)
+		carry = carry>>8 + sum>>8
 	}
-	plainMd5sum = hash.Sum(nil)
-	return
+
+	stream := cipher.NewCTR(block, ctr)
+	// ブロックの途中から始まる場合は端数分を読み捨てる
+	skip := make([]byte, off%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
 }
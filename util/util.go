@@ -2,6 +2,7 @@ package util
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
@@ -21,3 +22,21 @@ func GetMD5(fileName string) (string, error) {
 	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
+
+/*
+MD5とSHA-256を1回の読み込みで求める
+*/
+func GetSums(fileName string) (string, string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	defer f.Close()
+
+	m := md5.New()
+	s := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(m, s), f); err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("%x", m.Sum(nil)), fmt.Sprintf("%x", s.Sum(nil)), nil
+}